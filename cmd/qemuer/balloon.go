@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/c1rcu17/qemuer/config"
+	"github.com/c1rcu17/qemuer/qmp"
+	"github.com/urfave/cli/v2"
+)
+
+const balloonPath = "/machine/peripheral/balloon0"
+
+type (
+	balloonInfo struct {
+		Actual int64 `json:"actual"`
+	}
+
+	balloonStats struct {
+		Stats      map[string]int64 `json:"stats"`
+		LastUpdate int64            `json:"last-update"`
+	}
+
+	balloonView struct {
+		Size, Actual string
+		Stats        map[string]string
+		Updated      string
+	}
+)
+
+var balloonStatNames = []string{
+	"stat-total-memory", "stat-available-memory", "stat-free-memory", "stat-disk-caches",
+	"stat-major-faults", "stat-minor-faults", "stat-swap-in", "stat-swap-out",
+}
+
+var balloonTemplate = template.Must(template.New("").Parse(strings.TrimLeft(`
+Memory:    {{ .Size }}
+Balloon:   {{ .Actual }}
+Total:     {{ index .Stats "stat-total-memory" }}
+Available: {{ index .Stats "stat-available-memory" }}
+Free:      {{ index .Stats "stat-free-memory" }}
+Cached:    {{ index .Stats "stat-disk-caches" }}
+Faults:    {{ index .Stats "stat-major-faults" }} major, {{ index .Stats "stat-minor-faults" }} minor
+Swap:      {{ index .Stats "stat-swap-in" }} in, {{ index .Stats "stat-swap-out" }} out
+Updated:   {{ .Updated }}
+`, "\n")))
+
+func balloonCmd(ctx *cli.Context) error {
+	ec, err := prepareConfig(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	if ctx.NArg() > 1 {
+		return fmt.Errorf("too many arguments, expected at most a TARGET size")
+	}
+
+	if ctx.NArg() == 1 {
+		target, err := config.ParseSize(ctx.Args().First())
+
+		if err != nil {
+			return err
+		}
+
+		if target < config.MiB || target > ec.Memory.Size {
+			return fmt.Errorf("balloon target %v out of range 1 MiB - %v", target, ec.Memory.Size)
+		}
+
+		return qmpCommand(ctx, ec, "balloon", map[string]int64{"value": int64(target)}, nil)
+	}
+
+	interval := ctx.Int("interval")
+
+	if interval < 1 {
+		return fmt.Errorf("interval must be greater than 0")
+	}
+
+	// The guest only reports statistics once a polling interval is set
+	if err := qmpCommand(ctx, ec, "qom-set", map[string]interface{}{
+		"path": balloonPath, "property": "guest-stats-polling-interval", "value": interval}, nil); err != nil {
+		return err
+	}
+
+	if ctx.Bool("dry-run") {
+		return nil
+	}
+
+	m, err := dialQMP(ec)
+
+	if err != nil {
+		return err
+	}
+
+	defer m.Close()
+
+	for {
+		view, err := balloonStatus(m, ec)
+
+		if err != nil {
+			return err
+		}
+
+		if err := balloonTemplate.Execute(os.Stdout, view); err != nil {
+			return err
+		}
+
+		if !ctx.Bool("watch") {
+			return nil
+		}
+
+		time.Sleep(time.Duration(interval) * time.Second)
+		fmt.Println()
+	}
+}
+
+func balloonStatus(m *qmp.Monitor, ec *config.EnrichedConfig) (*balloonView, error) {
+	var info balloonInfo
+	var stats balloonStats
+
+	if err := m.Execute("query-balloon", nil, &info); err != nil {
+		return nil, err
+	}
+
+	if err := m.Execute("qom-get", map[string]string{"path": balloonPath, "property": "guest-stats"}, &stats); err != nil {
+		return nil, err
+	}
+
+	view := &balloonView{
+		Size:    ec.Memory.Size.String(),
+		Actual:  humanSize(info.Actual),
+		Stats:   map[string]string{},
+		Updated: "never",
+	}
+
+	if stats.LastUpdate > 0 {
+		view.Updated = time.Unix(stats.LastUpdate, 0).Format(time.RFC3339)
+	}
+
+	for _, k := range balloonStatNames {
+		view.Stats[k] = "-"
+	}
+
+	// The guest reports -1 for statistics it doesn't support
+	for k, v := range stats.Stats {
+		switch {
+		case v < 0:
+			view.Stats[k] = "-"
+		case strings.HasSuffix(k, "-memory"), k == "stat-disk-caches", strings.HasPrefix(k, "stat-swap-"):
+			view.Stats[k] = humanSize(v)
+		default:
+			view.Stats[k] = fmt.Sprint(v)
+		}
+	}
+
+	return view, nil
+}
+
+func humanSize(bytes int64) string {
+	for _, u := range []struct {
+		size config.Size
+		name string
+	}{{config.TiB, "TiB"}, {config.GiB, "GiB"}, {config.MiB, "MiB"}, {config.KiB, "KiB"}} {
+		if bytes >= int64(u.size) {
+			return fmt.Sprintf("%.1f %s", float64(bytes)/float64(u.size), u.name)
+		}
+	}
+
+	return fmt.Sprintf("%d B", bytes)
+}
+
+func balloonDevice(ec *config.EnrichedConfig) string {
+	device := virtio(ec, "virtio-balloon") + ",id=balloon0"
+
+	if ec.Memory.FreePageReporting {
+		device += ",free-page-reporting=on"
+	}
+
+	return device
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/c1rcu17/qemuer/config"
+	"github.com/urfave/cli/v2"
+)
+
+func bootIndex(indexes map[string]int, id string) string {
+	if i, ok := indexes[id]; ok {
+		return fmt.Sprintf(",bootindex=%d", i)
+	}
+
+	return ""
+}
+
+func bootArgs(ec *config.EnrichedConfig, indexes map[string]int) []string {
+	menu := len(indexes) > 1
+
+	if ec.Boot.Menu != nil {
+		menu = *ec.Boot.Menu
+	}
+
+	if !menu {
+		return nil
+	}
+
+	boot := "menu=on"
+
+	if ec.Boot.SplashTime > 0 {
+		boot += fmt.Sprintf(",splash-time=%d", ec.Boot.SplashTime)
+	}
+
+	return []string{"-boot", boot}
+}
+
+// The firmware reads the boot order when the machine starts or resets, so
+// restoring it right away makes the once device boot a single time. Indexes
+// must stay unique, so they are all cleared before being set again.
+func restoreBootOrder(ctx *cli.Context, ec *config.EnrichedConfig, once map[string]int) error {
+	normal, err := ec.BootIndexes("")
+
+	if err != nil {
+		return err
+	}
+
+	m, err := openQMP(ctx, ec)
+
+	if err != nil {
+		return err
+	}
+
+	defer m.Close()
+
+	set := func(id string, index int) error {
+		return m.Execute("qom-set", map[string]interface{}{
+			"path": "/machine/peripheral/" + id, "property": "bootindex", "value": index}, nil)
+	}
+
+	ids := []string{}
+
+	for id := range once {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		if err := set(id, -1); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range ec.BootOrder {
+		if err := set(id, normal[id]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -2,17 +2,27 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/c1rcu17/qemuer/config"
+	"github.com/c1rcu17/qemuer/qmp"
 	"github.com/urfave/cli/v2"
 	"gopkg.in/yaml.v2"
 )
 
+const (
+	socketTimeout = 5 * time.Second
+	sysfsRoot     = "/sys"
+)
+
 func prepareConfig(ctx *cli.Context) (*config.EnrichedConfig, error) {
 	yamlFile := ctx.String("file")
 	yamlData, err := ioutil.ReadFile(yamlFile)
@@ -50,6 +60,171 @@ func execv(ctx *cli.Context, prog config.Prog, args []string) error {
 	return nil
 }
 
+func run(ctx *cli.Context, prog config.Prog, args []string) error {
+	if ctx.Bool("dry-run") {
+		fmt.Println(strings.Join(append([]string{prog.Name}, args...), " "))
+		return nil
+	}
+
+	cmd := exec.Command(prog.Path, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func spawn(ctx *cli.Context, prog config.Prog, args []string, logFile string) (int, error) {
+	if ctx.Bool("dry-run") {
+		fmt.Println(strings.Join(append([]string{prog.Name}, args...), " "), "&")
+		return 0, nil
+	}
+
+	log, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer log.Close()
+
+	cmd := exec.Command(prog.Path, args...)
+	cmd.Stdout = log
+	cmd.Stderr = log
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+
+	pid := cmd.Process.Pid
+
+	if err := cmd.Process.Release(); err != nil {
+		return 0, err
+	}
+
+	return pid, nil
+}
+
+func cmdError(err error, out []byte) error {
+	if msg := strings.TrimSpace(string(out)); len(msg) > 0 {
+		return fmt.Errorf("%v: %s", err, msg)
+	}
+
+	return err
+}
+
+func writePIDFile(file string, pid int) error {
+	return ioutil.WriteFile(file, []byte(fmt.Sprintf("%d\n", pid)), 0644)
+}
+
+func readPIDFile(file string) (int, error) {
+	data, err := ioutil.ReadFile(file)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+func killPIDFile(file string) error {
+	pid, err := readPIDFile(file)
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	defer os.Remove(file)
+
+	if alive(pid) {
+		if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func waitSocket(file string) error {
+	for start := time.Now(); time.Since(start) < socketTimeout; time.Sleep(100 * time.Millisecond) {
+		if _, err := os.Stat(file); err == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("timeout waiting for %s", file)
+}
+
+func alive(pid int) bool {
+	if pid < 1 {
+		return false
+	}
+
+	return syscall.Kill(pid, 0) != syscall.ESRCH
+}
+
+type (
+	qmpExecutor interface {
+		Execute(cmd string, args interface{}, result interface{}) error
+		Close() error
+	}
+
+	// dryRunQMP prints the commands instead of executing them
+	dryRunQMP struct{}
+)
+
+func (dryRunQMP) Execute(cmd string, args interface{}, result interface{}) error {
+	data, err := json.Marshal(map[string]interface{}{"execute": cmd, "arguments": args})
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(data))
+	return nil
+}
+
+func (dryRunQMP) Close() error {
+	return nil
+}
+
+func dialQMP(ec *config.EnrichedConfig) (*qmp.Monitor, error) {
+	if !alive(ec.PID) {
+		return nil, fmt.Errorf("virtual machine %s is not running", ec.Name)
+	}
+
+	return qmp.Dial(ec.QMP, socketTimeout)
+}
+
+func openQMP(ctx *cli.Context, ec *config.EnrichedConfig) (qmpExecutor, error) {
+	if ctx.Bool("dry-run") {
+		return dryRunQMP{}, nil
+	}
+
+	return dialQMP(ec)
+}
+
+// qmpCommand runs a single QMP command, or prints it when dry-running
+func qmpCommand(ctx *cli.Context, ec *config.EnrichedConfig, cmd string, args interface{}, result interface{}) error {
+	m, err := openQMP(ctx, ec)
+
+	if err != nil {
+		return err
+	}
+
+	defer m.Close()
+
+	return m.Execute(cmd, args, result)
+}
+
 func monitorCommand(ec *config.EnrichedConfig, cmd string) error {
 	stdin := &bytes.Buffer{}
 
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/c1rcu17/qemuer/config"
+)
+
+func inputArgs(ec *config.EnrichedConfig) []string {
+	devices := map[config.Input]string{
+		config.InputKeyboard: "usb-kbd",
+		config.InputMouse:    "usb-mouse",
+		config.InputTablet:   "usb-tablet",
+	}
+
+	var args []string
+
+	for i, in := range ec.Input {
+		device, ok := devices[in]
+
+		if !ok {
+			device = virtio(ec, string(in))
+		}
+
+		args = append(args, "-device", fmt.Sprintf("%s,id=input%d", device, i))
+	}
+
+	return args
+}
+
+// The HDA controller matches the chipset, and the duplex codec gives the
+// guest both an output and an input
+func audioArgs(ec *config.EnrichedConfig) []string {
+	var audiodev string
+
+	switch ec.Audio {
+	case config.AudioWAV:
+		audiodev = fmt.Sprintf("wav,id=snd0,path=%s", ec.AudioFile)
+	case config.AudioPipeWire:
+		audiodev = "pipewire,id=snd0"
+	default:
+		return nil
+	}
+
+	hda := "intel-hda"
+
+	if ec.Machine.Type == config.MachineQ35 {
+		hda = "ich9-intel-hda"
+	}
+
+	return []string{
+		"-audiodev", audiodev,
+		"-device", fmt.Sprintf("%s,id=sound0", hda),
+		"-device", "hda-duplex,bus=sound0.0,audiodev=snd0"}
+}
+
+func usbStorageArgs(ec *config.EnrichedConfig) []string {
+	var args []string
+
+	for _, d := range ec.USBStorage {
+		args = append(args,
+			"-drive", fmt.Sprintf("id=%s,if=none,format=%s,file=%s", d.Drive, d.Format, d.Path),
+			"-device", fmt.Sprintf("usb-storage,id=%s,drive=%s,removable=on", d.ID, d.Drive))
+	}
+
+	return args
+}
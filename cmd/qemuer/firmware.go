@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/c1rcu17/qemuer/config"
+	"github.com/c1rcu17/qemuer/firmware"
+	"github.com/c1rcu17/qemuer/static"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	ovmfResource = "/OVMF-pure-efi.fd"
+	fvLenOffset  = 0x20
+	fvSigOffset  = 0x28
+)
+
+var firmwareTemplate = template.Must(template.New("").Funcs(template.FuncMap{"join": strings.Join}).Parse(strings.TrimLeft(`
+Embedded:
+{{- range .Resources }}
+  {{ .Name }}
+    Version: {{ .Version }}
+    SHA256:  {{ .Hash }}
+{{- end }}
+System:{{ if not .Descriptors }}    -{{ end }}
+{{- range .Descriptors }}
+  {{ .Name }}
+    Description: {{ .Description }}
+    Interfaces:  {{ join .InterfaceTypes ", " }}
+    Features:    {{ join .Features ", " }}
+{{- end }}
+`, "\n")))
+
+func firmwareCmd(ctx *cli.Context) error {
+	resources, err := static.Resources()
+
+	if err != nil {
+		return err
+	}
+
+	descs, err := firmware.Load(firmware.SearchPaths()...)
+
+	if err != nil {
+		return err
+	}
+
+	return firmwareTemplate.Execute(os.Stdout, struct {
+		Resources   []static.Resource
+		Descriptors []firmware.Descriptor
+	}{resources, descs})
+}
+
+func installFirmware(ec *config.EnrichedConfig) error {
+	if ec.Firmware.Embedded {
+		if err := installEmbeddedFirmware(ec.Firmware); err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Stat(ec.Firmware.Vars); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.MkdirAll(ec.State, 0755); err != nil {
+		return err
+	}
+
+	return copyFile(ec.Firmware.VarsTemplate, ec.Firmware.Vars)
+}
+
+// The embedded image is a unified OVMF build: its first firmware volume holds
+// the variable store and the rest is the code, which lets every VM keep its
+// own variables while sharing the code.
+func installEmbeddedFirmware(fw config.Firmware) error {
+	resource, err := static.LookupResource(ovmfResource)
+
+	if err != nil {
+		return err
+	}
+
+	// The stamp records which resource the cached files were extracted from,
+	// so upgrading qemuer refreshes them
+	stamp := fw.Code + ".sha256"
+
+	if installed, err := ioutil.ReadFile(stamp); err == nil && strings.TrimSpace(string(installed)) == resource.Hash {
+		if _, err := os.Stat(fw.Code); err == nil {
+			return nil
+		}
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	src, err := static.OpenResource(ovmfResource)
+
+	if err != nil {
+		return err
+	}
+
+	defer src.Close()
+
+	data, err := ioutil.ReadAll(src)
+
+	if err != nil {
+		return err
+	}
+
+	if len(data) < fvSigOffset+4 || !bytes.Equal(data[fvSigOffset:fvSigOffset+4], []byte("_FVH")) {
+		return fmt.Errorf("resource %s: not an OVMF flash image", ovmfResource)
+	}
+
+	varsLen := binary.LittleEndian.Uint64(data[fvLenOffset:])
+
+	if varsLen >= uint64(len(data)) {
+		return fmt.Errorf("resource %s: invalid variable store size %d", ovmfResource, varsLen)
+	}
+
+	if err := ioutil.WriteFile(fw.VarsTemplate, data[:varsLen], 0644); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(fw.Code, data[varsLen:], 0644); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(stamp, []byte(resource.Hash+"\n"), 0644)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.Create(dst)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/c1rcu17/qemuer/config"
+)
+
+type forwardRule struct {
+	config.PortForward
+	IP, Bridge string
+}
+
+// The DNAT only catches connections to the host's own addresses, so guests
+// can still reach the same ports elsewhere. Loopback isn't forwarded, since
+// that needs route_localnet on the bridge, which exposes the host's loopback
+// services to the guests.
+var forwardTemplate = template.Must(template.New("").Parse(strings.TrimLeft(`
+add table ip qemuer-{{ .ID }}
+delete table ip qemuer-{{ .ID }}
+table ip qemuer-{{ .ID }} {
+    chain prerouting {
+        type nat hook prerouting priority -100; policy accept;
+{{- range .Rules }}
+        fib daddr type local {{ .Proto }} dport {{ .HostPort }} dnat to {{ .IP }}:{{ .GuestPort }}
+{{- end }}
+    }
+    chain output {
+        type nat hook output priority -100; policy accept;
+{{- range .Rules }}
+        ip daddr != 127.0.0.0/8 fib daddr type local {{ .Proto }} dport {{ .HostPort }} dnat to {{ .IP }}:{{ .GuestPort }}
+{{- end }}
+    }
+}
+`, "\n")))
+
+// An accept in a chain of our own can't override the reject libvirt adds to
+// its forward chain for new connections into NAT networks, so the forwarded
+// ones are accepted in libvirt's chain itself. The first chain is used by the
+// nftables backend of libvirt 10.4 and later, the second one by the iptables
+// backend of libvirt 5.1 and later, as long as iptables uses nftables.
+var libvirtChains = [][]string{{"ip", "libvirt_network", "guest_input"}, {"ip", "filter", "LIBVIRT_FWI"}}
+
+var handleRegexp = regexp.MustCompile(`# handle (\d+)$`)
+
+type forwarder struct {
+	ec        *config.EnrichedConfig
+	ips       map[int]string
+	installed bool
+}
+
+func newForwarder(ec *config.EnrichedConfig) *forwarder {
+	return &forwarder{ec: ec, ips: make(map[int]string)}
+}
+
+func (f *forwarder) update() error {
+	changed := false
+
+	for i, n := range f.ec.Networks {
+		if len(n.PortForwards) < 1 {
+			continue
+		}
+
+		ip := n.IP
+
+		if len(ip) < 1 {
+			var err error
+
+			if ip, err = leaseIP(&n, f.ec.Progs.Virsh); err != nil {
+				return err
+			}
+		}
+
+		if len(ip) > 0 && ip != f.ips[i] {
+			f.ips[i] = ip
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	var rules []forwardRule
+
+	for i, n := range f.ec.Networks {
+		if ip, exists := f.ips[i]; exists {
+			for _, pf := range n.PortForwards {
+				rules = append(rules, forwardRule{PortForward: pf, IP: ip, Bridge: n.BridgeDev})
+			}
+		}
+	}
+
+	var ruleset bytes.Buffer
+
+	if err := forwardTemplate.Execute(&ruleset, struct {
+		ID    string
+		Rules []forwardRule
+	}{f.ec.ID, rules}); err != nil {
+		return err
+	}
+
+	nft := exec.Command(f.ec.Progs.Nft.Path, "-f", "-")
+	nft.Stdin = &ruleset
+
+	if out, err := nft.CombinedOutput(); err != nil {
+		return cmdError(err, out)
+	}
+
+	f.installed = true
+
+	return f.accept(rules)
+}
+
+func (f *forwarder) close() error {
+	if !f.installed {
+		return nil
+	}
+
+	if err := f.accept(nil); err != nil {
+		return err
+	}
+
+	if out, err := exec.Command(f.ec.Progs.Nft.Path, "delete", "table", "ip", "qemuer-"+f.ec.ID).CombinedOutput(); err != nil {
+		return cmdError(err, out)
+	}
+
+	f.installed = false
+
+	return nil
+}
+
+// accept replaces the rules tagged with the VM id in libvirt's chain
+func (f *forwarder) accept(rules []forwardRule) error {
+	comment := "qemuer-" + f.ec.ID
+	var chain []string
+	var listing []byte
+
+	for _, c := range libvirtChains {
+		if out, err := exec.Command(f.ec.Progs.Nft.Path, append([]string{"-a", "list", "chain"}, c...)...).Output(); err == nil {
+			chain, listing = c, out
+			break
+		}
+	}
+
+	if chain == nil {
+		if len(rules) < 1 {
+			return nil
+		}
+
+		return fmt.Errorf("no libvirt forward chain found in %v, forwards require libvirt with an nftables firewall", libvirtChains)
+	}
+
+	for _, line := range strings.Split(string(listing), "\n") {
+		if m := handleRegexp.FindStringSubmatch(line); m != nil && strings.Contains(line, fmt.Sprintf("comment %q", comment)) {
+			args := append(append([]string{"delete", "rule"}, chain...), "handle", m[1])
+
+			if out, err := exec.Command(f.ec.Progs.Nft.Path, args...).CombinedOutput(); err != nil {
+				return cmdError(err, out)
+			}
+		}
+	}
+
+	for _, r := range rules {
+		args := append(append([]string{"insert", "rule"}, chain...),
+			"oifname", r.Bridge, "ip", "daddr", r.IP, r.Proto, "dport", strconv.Itoa(r.GuestPort),
+			"ct", "status", "dnat", "accept", "comment", strconv.Quote(comment))
+
+		if out, err := exec.Command(f.ec.Progs.Nft.Path, args...).CombinedOutput(); err != nil {
+			return cmdError(err, out)
+		}
+	}
+
+	return nil
+}
+
+func leaseIP(en *config.EnrichedNetwork, virsh config.Prog) (string, error) {
+	out, err := exec.Command(virsh.Path, "net-dhcp-leases", en.Name, "--mac", en.MAC).CombinedOutput()
+
+	if err != nil {
+		return "", cmdError(err, out)
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+
+		for i, field := range fields {
+			if field != "ipv4" || i+1 >= len(fields) {
+				continue
+			}
+
+			if ip, _, err := net.ParseCIDR(fields[i+1]); err == nil {
+				return ip.String(), nil
+			}
+		}
+	}
+
+	return "", nil
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/c1rcu17/qemuer/config"
+	"github.com/c1rcu17/qemuer/qmp"
+	"github.com/urfave/cli/v2"
+)
+
+const unplugTimeout = 10 * time.Second
+
+type hotpluggableCPU struct {
+	Type    string         `json:"type"`
+	Props   map[string]int `json:"props"`
+	QOMPath string         `json:"qom-path"`
+}
+
+var cpuPropOrder = []string{"node-id", "socket-id", "die-id", "cluster-id", "core-id", "thread-id"}
+
+func attachDiskCmd(ctx *cli.Context) error {
+	ec, m, err := prepareHotplug(ctx, 1)
+
+	if err != nil {
+		return err
+	}
+
+	defer m.Close()
+
+	file, err := filepath.Abs(ctx.Args().First())
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(file); err != nil {
+		return err
+	}
+
+	port, err := ec.HotplugPort()
+
+	if err != nil {
+		return err
+	}
+
+	d := config.HotplugDisk{ID: nextID("hpdisk", ec.Plugged.IDs()), Path: file, Format: ctx.String("format"), Port: port}
+
+	if err := m.Execute("blockdev-add", map[string]interface{}{
+		"driver":    d.Format,
+		"node-name": d.ID,
+		"file":      map[string]string{"driver": "file", "filename": d.Path},
+	}, nil); err != nil {
+		return err
+	}
+
+	if err := m.Execute("device_add", hotplugDevice(ec, "virtio-blk", d.ID, d.Port, "drive", d.ID), nil); err != nil {
+		m.Execute("blockdev-del", map[string]string{"node-name": d.ID}, nil)
+		return err
+	}
+
+	ec.Plugged.Disks = append(ec.Plugged.Disks, d)
+
+	if err := saveHotplug(ctx, ec); err != nil {
+		return err
+	}
+
+	fmt.Println(d.ID)
+
+	return nil
+}
+
+func detachDiskCmd(ctx *cli.Context) error {
+	ec, m, err := prepareHotplug(ctx, 1)
+
+	if err != nil {
+		return err
+	}
+
+	defer m.Close()
+
+	id := ctx.Args().First()
+
+	for i, d := range ec.Plugged.Disks {
+		if d.ID == id {
+			if err := unplug(ctx, m, id); err != nil {
+				return err
+			}
+
+			if err := m.Execute("blockdev-del", map[string]string{"node-name": id}, nil); err != nil {
+				return err
+			}
+
+			ec.Plugged.Disks = append(ec.Plugged.Disks[:i], ec.Plugged.Disks[i+1:]...)
+
+			return saveHotplug(ctx, ec)
+		}
+	}
+
+	return fmt.Errorf("no hotplugged disk %s", id)
+}
+
+func attachNICCmd(ctx *cli.Context) error {
+	ec, m, err := prepareHotplug(ctx, 1)
+
+	if err != nil {
+		return err
+	}
+
+	defer m.Close()
+
+	index, err := strconv.Atoi(ctx.Args().First())
+
+	if err != nil || index < 0 || index >= len(ec.Networks) {
+		return fmt.Errorf("invalid network %s, choose an index from 0 to %d", ctx.Args().First(), len(ec.Networks)-1)
+	}
+
+	port, err := ec.HotplugPort()
+
+	if err != nil {
+		return err
+	}
+
+	mac, err := ec.HotplugMAC(ctx.String("mac"))
+
+	if err != nil {
+		return err
+	}
+
+	n := ec.Networks[index]
+	nic := config.HotplugNIC{ID: nextID("hpnic", ec.Plugged.IDs()), Network: index, MAC: mac, Port: port}
+
+	netdev := map[string]interface{}{"id": nic.ID}
+
+	switch n.Mode {
+	case config.NetworkNAT:
+		netdev["type"] = "bridge"
+		netdev["br"] = n.BridgeDev
+	case config.NetworkIsolated:
+		netdev["type"] = "socket"
+		netdev["mcast"] = n.MCast
+		netdev["localaddr"] = "127.0.0.1"
+	}
+
+	if err := m.Execute("netdev_add", netdev, nil); err != nil {
+		return err
+	}
+
+	device := hotplugDevice(ec, "virtio-net", nic.ID, nic.Port, "netdev", nic.ID)
+	device["mac"] = nic.MAC
+
+	if err := m.Execute("device_add", device, nil); err != nil {
+		m.Execute("netdev_del", map[string]string{"id": nic.ID}, nil)
+		return err
+	}
+
+	ec.Plugged.NICs = append(ec.Plugged.NICs, nic)
+
+	if err := saveHotplug(ctx, ec); err != nil {
+		return err
+	}
+
+	fmt.Println(nic.ID)
+
+	return nil
+}
+
+func detachNICCmd(ctx *cli.Context) error {
+	ec, m, err := prepareHotplug(ctx, 1)
+
+	if err != nil {
+		return err
+	}
+
+	defer m.Close()
+
+	id := ctx.Args().First()
+
+	for i, n := range ec.Plugged.NICs {
+		if n.ID == id {
+			if err := unplug(ctx, m, id); err != nil {
+				return err
+			}
+
+			if err := m.Execute("netdev_del", map[string]string{"id": id}, nil); err != nil {
+				return err
+			}
+
+			ec.Plugged.NICs = append(ec.Plugged.NICs[:i], ec.Plugged.NICs[i+1:]...)
+
+			return saveHotplug(ctx, ec)
+		}
+	}
+
+	return fmt.Errorf("no hotplugged nic %s", id)
+}
+
+func attachCPUCmd(ctx *cli.Context) error {
+	ec, m, err := prepareHotplug(ctx, 0)
+
+	if err != nil {
+		return err
+	}
+
+	defer m.Close()
+
+	count, err := hotplugCount(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	var cpus []hotpluggableCPU
+
+	if ctx.Bool("dry-run") {
+		cpus = plannedCPUs(ec)
+	} else if err := m.Execute("query-hotpluggable-cpus", nil, &cpus); err != nil {
+		return err
+	}
+
+	free := []hotpluggableCPU{}
+
+	for _, c := range cpus {
+		if len(c.QOMPath) < 1 {
+			free = append(free, c)
+		}
+	}
+
+	if count > len(free) {
+		return fmt.Errorf("only %d hotpluggable vcpus left, raise cpu.maxcpus in %s", len(free), ec.File)
+	}
+
+	// Fill the topology in order, QEMU lists it backwards
+	sort.Slice(free, func(i, j int) bool {
+		for _, p := range cpuPropOrder {
+			if free[i].Props[p] != free[j].Props[p] {
+				return free[i].Props[p] < free[j].Props[p]
+			}
+		}
+
+		return false
+	})
+
+	for _, c := range free[:count] {
+		id := nextID("hpcpu", ec.Plugged.IDs())
+		device := map[string]interface{}{"driver": c.Type, "id": id}
+
+		for k, v := range c.Props {
+			device[k] = v
+		}
+
+		if err := m.Execute("device_add", device, nil); err != nil {
+			return err
+		}
+
+		ec.Plugged.CPUs = append(ec.Plugged.CPUs, id)
+
+		if err := saveHotplug(ctx, ec); err != nil {
+			return err
+		}
+
+		fmt.Println(id)
+	}
+
+	// New vCPU threads don't inherit the pinning of the running ones
+	if len(ec.CPU.VCPUPins) > 0 {
+		return pinVCPUs(ec, m)
+	}
+
+	return nil
+}
+
+func detachCPUCmd(ctx *cli.Context) error {
+	ec, m, err := prepareHotplug(ctx, 0)
+
+	if err != nil {
+		return err
+	}
+
+	defer m.Close()
+
+	count, err := hotplugCount(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	if count > len(ec.Plugged.CPUs) {
+		return fmt.Errorf("only %d hotplugged vcpus to detach", len(ec.Plugged.CPUs))
+	}
+
+	// Last plugged, first unplugged
+	for i := 0; i < count; i++ {
+		last := len(ec.Plugged.CPUs) - 1
+		id := ec.Plugged.CPUs[last]
+
+		if err := unplug(ctx, m, id); err != nil {
+			return err
+		}
+
+		ec.Plugged.CPUs = ec.Plugged.CPUs[:last]
+
+		if err := saveHotplug(ctx, ec); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func prepareHotplug(ctx *cli.Context, args int) (*config.EnrichedConfig, qmpExecutor, error) {
+	if ctx.NArg() < args {
+		return nil, nil, fmt.Errorf("missing argument %s", ctx.Command.ArgsUsage)
+	}
+
+	ec, err := prepareConfig(ctx)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if ec.Machine.Type == config.MachineMicroVM {
+		return nil, nil, fmt.Errorf("hotplug is not supported by machine %s", ec.Machine.Type)
+	}
+
+	m, err := openQMP(ctx, ec)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ec, m, nil
+}
+
+func hotplugCount(ctx *cli.Context) (int, error) {
+	if ctx.NArg() < 1 {
+		return 1, nil
+	}
+
+	count, err := strconv.Atoi(ctx.Args().First())
+
+	if err != nil || count < 1 {
+		return 0, fmt.Errorf("invalid count %s", ctx.Args().First())
+	}
+
+	return count, nil
+}
+
+func hotplugDevice(ec *config.EnrichedConfig, device, id, port, backendKey, backend string) map[string]interface{} {
+	d := map[string]interface{}{"driver": virtio(ec, device), "id": id, backendKey: backend}
+
+	if len(port) > 0 {
+		d["bus"] = port
+	}
+
+	return d
+}
+
+// The guest has to release the device before its backend can be removed
+func unplug(ctx *cli.Context, m qmpExecutor, id string) error {
+	if err := m.Execute("device_del", map[string]string{"id": id}, nil); err != nil {
+		return err
+	}
+
+	if ctx.Bool("dry-run") {
+		return nil
+	}
+
+	for start := time.Now(); time.Since(start) < unplugTimeout; time.Sleep(200 * time.Millisecond) {
+		var qerr *qmp.Error
+
+		if err := m.Execute("qom-get", map[string]string{"path": "/machine/peripheral/" + id, "property": "type"}, nil); errors.As(err, &qerr) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return fmt.Errorf("device %s was not released by the guest", id)
+}
+
+func saveHotplug(ctx *cli.Context, ec *config.EnrichedConfig) error {
+	if ctx.Bool("dry-run") {
+		return nil
+	}
+
+	return ec.SaveHotplug()
+}
+
+// plannedCPUs stands in for query-hotpluggable-cpus when dry-running, laying
+// out the topology like QEMU does, with the boot and plugged vCPUs taken
+func plannedCPUs(ec *config.EnrichedConfig) []hotpluggableCPU {
+	arch := string(ec.Arch)
+
+	if ec.Arch == config.ArchAArch64 {
+		arch = "arm"
+	}
+
+	taken := ec.CPU.Count + len(ec.Plugged.CPUs)
+	cpus := make([]hotpluggableCPU, 0, ec.CPU.MaxCPUs)
+	dies := ec.CPU.Dies
+
+	if dies < 1 {
+		dies = 1
+	}
+
+	for i := 0; i < ec.CPU.MaxCPUs; i++ {
+		c := hotpluggableCPU{
+			Type: fmt.Sprintf("%s-%s-cpu", ec.CPU.Model, arch),
+			Props: map[string]int{
+				"socket-id": i / (ec.CPU.Threads * ec.CPU.Cores * dies),
+				"core-id":   i / ec.CPU.Threads % ec.CPU.Cores,
+				"thread-id": i % ec.CPU.Threads,
+			},
+		}
+
+		if dies > 1 {
+			c.Props["die-id"] = i / (ec.CPU.Threads * ec.CPU.Cores) % dies
+		}
+
+		if i < taken {
+			c.QOMPath = fmt.Sprintf("/machine/unattached/device[%d]", i)
+		}
+
+		cpus = append(cpus, c)
+	}
+
+	return cpus
+}
+
+func nextID(prefix string, used []string) string {
+	for i := 0; ; i++ {
+		id := fmt.Sprintf("%s%d", prefix, i)
+		taken := false
+
+		for _, u := range used {
+			if u == id {
+				taken = true
+				break
+			}
+		}
+
+		if !taken {
+			return id
+		}
+	}
+}
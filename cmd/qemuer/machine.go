@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/c1rcu17/qemuer/config"
+)
+
+func machineArgs(ec *config.EnrichedConfig) []string {
+	options := []string{ec.Machine.Name, "accel=kvm", "dump-guest-core=off"}
+	args := []string{}
+
+	switch ec.Machine.Type {
+	case config.MachineQ35, config.MachinePC:
+		options = append(options, "vmport=off")
+		args = append(args, "-no-hpet")
+	case config.MachineMicroVM:
+		// Legacy devices only slow the boot down, the serial port is the console
+		options = append(options, "pit=off", "pic=off", "isa-serial=on")
+	case config.MachineVirt:
+		options = append(options, "gic-version=host")
+	}
+
+	if ec.Firmware.SMM {
+		options = append(options, "smm=on")
+	}
+
+	return append([]string{"-machine", strings.Join(options, ",")}, args...)
+}
+
+// microvm has no PCI bus, its virtio devices sit on virtio-mmio transports
+func virtio(ec *config.EnrichedConfig, device string) string {
+	if !ec.Machine.PCI() {
+		return device + "-device"
+	}
+
+	return device + "-pci"
+}
+
+func serialArgs(ec *config.EnrichedConfig, chardev string) []string {
+	switch ec.Machine.Type {
+	case config.MachineQ35, config.MachinePC:
+		return []string{"-device", fmt.Sprintf("isa-serial,chardev=%s", chardev)}
+	default:
+		return []string{"-serial", fmt.Sprintf("chardev:%s", chardev)}
+	}
+}
+
+// The first drive keeps the second AHCI port on q35, the secondary IDE
+// master on i440fx
+func cdromDevice(ec *config.EnrichedConfig, index int) string {
+	switch ec.Machine.Type {
+	case config.MachineVirt:
+		return fmt.Sprintf("scsi-cd,bus=scsi0.0,scsi-id=%d", index)
+	case config.MachinePC:
+		slots := [][2]int{{1, 0}, {1, 1}, {0, 1}, {0, 0}}
+		return fmt.Sprintf("ide-cd,bus=ide.%d,unit=%d", slots[index][0], slots[index][1])
+	default:
+		return fmt.Sprintf("ide-cd,bus=ide.%d", (index+1)%6)
+	}
+}
+
+func usbArgs(ec *config.EnrichedConfig) []string {
+	switch ec.Machine.Type {
+	case config.MachineVirt:
+		return []string{"-device", "qemu-xhci,id=usb"}
+	default:
+		return []string{
+			"-device", "ich9-usb-ehci1,id=usb",
+			"-device", "ich9-usb-uhci1,masterbus=usb.0,firstport=0,multifunction=on",
+			"-device", "ich9-usb-uhci2,masterbus=usb.0,firstport=2",
+			"-device", "ich9-usb-uhci3,masterbus=usb.0,firstport=4"}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/c1rcu17/qemuer/config"
+	"github.com/urfave/cli/v2"
+)
+
+func mediaInsertCmd(ctx *cli.Context) error {
+	if ctx.NArg() < 1 {
+		return fmt.Errorf("missing argument %s", ctx.Command.ArgsUsage)
+	}
+
+	ec, cd, err := prepareMedia(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	file, err := filepath.Abs(ctx.Args().First())
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(file); err != nil {
+		return err
+	}
+
+	return qmpCommand(ctx, ec, "blockdev-change-medium", map[string]string{
+		"id":             cd.ID,
+		"filename":       file,
+		"format":         "raw",
+		"read-only-mode": "read-only",
+	}, nil)
+}
+
+func mediaEjectCmd(ctx *cli.Context) error {
+	ec, cd, err := prepareMedia(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	// Guests lock the tray of mounted discs, force it open
+	return qmpCommand(ctx, ec, "eject", map[string]interface{}{"id": cd.ID, "force": true}, nil)
+}
+
+func prepareMedia(ctx *cli.Context) (*config.EnrichedConfig, *config.CDROM, error) {
+	ec, err := prepareConfig(ctx)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	index := ctx.Int("cdrom")
+
+	if index < 0 || index >= len(ec.CDROMs) {
+		if len(ec.CDROMs) < 1 {
+			return nil, nil, fmt.Errorf("virtual machine %s has no cd-rom drives", ec.Name)
+		}
+
+		return nil, nil, fmt.Errorf("invalid cdrom %d, choose from 0 to %d", index, len(ec.CDROMs)-1)
+	}
+
+	return ec, &ec.CDROMs[index], nil
+}
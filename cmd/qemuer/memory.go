@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/c1rcu17/qemuer/config"
+	"github.com/c1rcu17/qemuer/util"
+)
+
+func memoryArgs(ec *config.EnrichedConfig) []string {
+	m := ec.Memory
+	size := fmt.Sprintf("size=%dM", m.Size.MiB())
+
+	if m.Slots > 0 {
+		size += fmt.Sprintf(",slots=%d,maxmem=%dM", m.Slots, m.MaxMem.MiB())
+	}
+
+	args := []string{"-m", size}
+
+	if len(m.Backend) < 1 {
+		return args
+	}
+
+	if len(m.NUMA) < 1 {
+		return append(args,
+			"-object", memoryBackend(ec, "mem0", m.Size, nil),
+			"-machine", "memory-backend=mem0")
+	}
+
+	for i, n := range m.NUMA {
+		id := fmt.Sprintf("mem%d", i)
+		node := fmt.Sprintf("node,nodeid=%d,memdev=%s", i, id)
+
+		for _, r := range util.FormatCPUSet(n.CPUSet) {
+			node += ",cpus=" + r
+		}
+
+		args = append(args, "-object", memoryBackend(ec, id, n.Memory, &m.NUMA[i]), "-numa", node)
+	}
+
+	return args
+}
+
+func memoryBackend(ec *config.EnrichedConfig, id string, size config.Size, node *config.EnrichedNUMANode) string {
+	opts := []string{}
+
+	switch ec.Memory.Backend {
+	case config.MemoryRAM:
+		opts = append(opts, "memory-backend-ram")
+	case config.MemoryMemFD:
+		opts = append(opts, "memory-backend-memfd")
+	case config.MemoryHugePages:
+		opts = append(opts, "memory-backend-memfd", "hugetlb=on", fmt.Sprintf("hugetlbsize=%dK", ec.Memory.PageSize/config.KiB))
+	}
+
+	opts = append(opts, "id="+id, fmt.Sprintf("size=%dM", size.MiB()))
+
+	if ec.Memory.Shared {
+		opts = append(opts, "share=on")
+	}
+
+	if ec.Memory.Prealloc {
+		opts = append(opts, "prealloc=on")
+	}
+
+	if node != nil && len(node.HostNodeSet) > 0 {
+		for _, r := range util.FormatCPUSet(node.HostNodeSet) {
+			opts = append(opts, "host-nodes="+r)
+		}
+
+		opts = append(opts, "policy="+string(node.Policy))
+	}
+
+	return strings.Join(opts, ",")
+}
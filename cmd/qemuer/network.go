@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"text/template"
+
+	"github.com/c1rcu17/qemuer/config"
+	"github.com/urfave/cli/v2"
+)
+
+type netDumpXML struct {
+	Forward struct {
+		Dev string `xml:"dev,attr"`
+	} `xml:"forward"`
+	Bridge struct {
+		Name string `xml:"name,attr"`
+	} `xml:"bridge"`
+	DNS struct {
+		Hosts []struct {
+			IP        string   `xml:"ip,attr"`
+			Hostnames []string `xml:"hostname"`
+		} `xml:"host"`
+	} `xml:"dns"`
+	IPs []netDumpIPXML `xml:"ip"`
+}
+
+type netDumpIPXML struct {
+	Family  string `xml:"family,attr"`
+	Address string `xml:"address,attr"`
+	Netmask string `xml:"netmask,attr"`
+	Prefix  int    `xml:"prefix,attr"`
+	TFTP    struct {
+		Root string `xml:"root,attr"`
+	} `xml:"tftp"`
+	DHCP struct {
+		Range struct {
+			Start string `xml:"start,attr"`
+			End   string `xml:"end,attr"`
+		} `xml:"range"`
+		Hosts []netDumpHostXML `xml:"host"`
+		BootP struct {
+			File   string `xml:"file,attr"`
+			Server string `xml:"server,attr"`
+		} `xml:"bootp"`
+	} `xml:"dhcp"`
+}
+
+type netDumpHostXML struct {
+	MAC  string `xml:"mac,attr"`
+	IP   string `xml:"ip,attr"`
+	Name string `xml:"name,attr"`
+}
+
+var networkTemplate = template.Must(template.New("").Parse(strings.TrimLeft(`
+<network>
+    <name>{{ .Name }}</name>
+    <forward mode='nat'{{ if .NatDev }} dev='{{ .NatDev }}'{{ end }}/>
+    <bridge name='{{ .BridgeDev }}'/>
+{{- if and .IP .Hostname }}
+    <dns>
+        <host ip='{{ .IP }}'>
+            <hostname>{{ .Hostname }}</hostname>
+        </host>
+    </dns>
+{{- end }}
+    <ip address='{{ .Gateway }}' netmask='{{ .Netmask }}'>
+{{- if .TFTP }}
+        <tftp root='{{ .TFTP }}'/>
+{{- end }}
+        <dhcp>
+            <range start='{{ .IPStart }}' end='{{ .IPEnd }}'/>
+{{- if or .IP .Hostname }}
+            {{ template "host" . }}
+{{- end }}
+{{- if .BootFile }}
+            <bootp file='{{ .BootFile }}'{{ if .BootServer }} server='{{ .BootServer }}'{{ end }}/>
+{{- end }}
+        </dhcp>
+    </ip>
+{{- if .Subnet6 }}
+    <ip family='ipv6' address='{{ .Gateway6 }}' prefix='{{ .Prefix6 }}'>
+{{- if .IPStart6 }}
+        <dhcp>
+            <range start='{{ .IPStart6 }}' end='{{ .IPEnd6 }}'/>
+        </dhcp>
+{{- end }}
+    </ip>
+{{- end }}
+</network>
+{{- define "host" }}<host mac='{{ .MAC }}'{{ if .IP }} ip='{{ .IP }}'{{ end }}{{ if .Hostname }} name='{{ .Hostname }}'{{ end }}/>{{ end }}
+`, "\n")))
+
+func createNetwork(ctx *cli.Context, en *config.EnrichedNetwork, virsh config.Prog) error {
+	if out, err := exec.Command(virsh.Path, "net-dumpxml", en.Name).CombinedOutput(); err != nil {
+		if !strings.Contains(string(out), "Network not found") {
+			return err
+		}
+	} else {
+		var net netDumpXML
+
+		if err := xml.Unmarshal(out, &net); err != nil {
+			return err
+		}
+
+		var ip, ip6 netDumpIPXML
+
+		for _, i := range net.IPs {
+			if i.Family == "ipv6" {
+				ip6 = i
+			} else {
+				ip = i
+			}
+		}
+
+		if net.Forward.Dev == en.NatDev &&
+			net.Bridge.Name == en.BridgeDev &&
+			ip.Address == en.Gateway &&
+			ip.Netmask == en.Netmask &&
+			ip.DHCP.Range.Start == en.IPStart &&
+			ip.DHCP.Range.End == en.IPEnd &&
+			ip.TFTP.Root == en.TFTP &&
+			ip.DHCP.BootP.File == en.BootFile &&
+			ip.DHCP.BootP.Server == en.BootServer &&
+			ip6.Address == en.Gateway6 &&
+			(len(en.Gateway6) < 1 || ip6.Prefix == en.Prefix6) &&
+			ip6.DHCP.Range.Start == en.IPStart6 &&
+			ip6.DHCP.Range.End == en.IPEnd6 {
+			return reserveHost(ctx, en, virsh, &net, &ip)
+		}
+
+		return fmt.Errorf("network %s exists with different settings", en.Name)
+	}
+
+	// The network is created from a temporary file, shown inline instead
+	if ctx.Bool("dry-run") {
+		fmt.Println(virsh.Name, "net-create", "/dev/stdin", "<<EOF")
+
+		if err := networkTemplate.Execute(os.Stdout, en); err != nil {
+			return err
+		}
+
+		fmt.Println("EOF")
+
+		return nil
+	}
+
+	f, err := ioutil.TempFile("", "net-*.xml")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(f.Name())
+
+	if err := networkTemplate.Execute(f, en); err != nil {
+		f.Close()
+		return err
+	}
+
+	f.Close()
+
+	if err := exec.Command(virsh.Path, "net-create", f.Name()).Run(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Reservations follow the VMFILE: a changed ip or hostname modifies the
+// entry for the MAC, and a removed one deletes it.
+func reserveHost(ctx *cli.Context, en *config.EnrichedNetwork, virsh config.Prog, net *netDumpXML, ip *netDumpIPXML) error {
+	var current *netDumpHostXML
+
+	for i, h := range ip.DHCP.Hosts {
+		switch {
+		case h.MAC == en.MAC:
+			current = &ip.DHCP.Hosts[i]
+		case len(en.IP) > 0 && h.IP == en.IP:
+			return fmt.Errorf("address %s: already reserved in network %s by %s", en.IP, en.Name, h.MAC)
+		case len(en.Hostname) > 0 && h.Name == en.Hostname:
+			return fmt.Errorf("hostname %s: already reserved in network %s by %s", en.Hostname, en.Name, h.MAC)
+		}
+	}
+
+	// libvirt can't modify DNS hosts, so a changed name is deleted and added
+	if current != nil && (current.IP != en.IP || current.Name != en.Hostname) {
+		if err := removeDNSHost(ctx, en.Name, virsh, net, current.IP); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case len(en.IP) < 1 && len(en.Hostname) < 1:
+		if current != nil {
+			return updateNetwork(ctx, en.Name, virsh, "delete", "ip-dhcp-host", fmt.Sprintf("<host mac='%s'/>", en.MAC))
+		}
+
+		return nil
+	case current == nil:
+		if err := updateHost(ctx, en, virsh, "add-last"); err != nil {
+			return err
+		}
+	case current.IP != en.IP || current.Name != en.Hostname:
+		if err := updateHost(ctx, en, virsh, "modify"); err != nil {
+			return err
+		}
+	}
+
+	if len(en.IP) < 1 || len(en.Hostname) < 1 {
+		return nil
+	}
+
+	if current != nil && current.IP == en.IP && current.Name == en.Hostname {
+		for _, h := range net.DNS.Hosts {
+			if h.IP == en.IP {
+				return nil
+			}
+		}
+	}
+
+	return updateNetwork(ctx, en.Name, virsh, "add-last", "dns-host", dnsHost(en))
+}
+
+// releaseHost drops the reservation and the DNS name of a stopped VM, so
+// they don't outlive its VMFILE.
+func releaseHost(ctx *cli.Context, en *config.EnrichedNetwork, virsh config.Prog) error {
+	if len(en.IP) < 1 && len(en.Hostname) < 1 {
+		return nil
+	}
+
+	out, err := exec.Command(virsh.Path, "net-dumpxml", en.Name).CombinedOutput()
+
+	if err != nil {
+		if strings.Contains(string(out), "Network not found") {
+			return nil
+		}
+
+		return cmdError(err, out)
+	}
+
+	var net netDumpXML
+
+	if err := xml.Unmarshal(out, &net); err != nil {
+		return err
+	}
+
+	for _, ip := range net.IPs {
+		for _, h := range ip.DHCP.Hosts {
+			if h.MAC != en.MAC {
+				continue
+			}
+
+			if err := removeDNSHost(ctx, en.Name, virsh, &net, h.IP); err != nil {
+				return err
+			}
+
+			return updateNetwork(ctx, en.Name, virsh, "delete", "ip-dhcp-host", fmt.Sprintf("<host mac='%s'/>", en.MAC))
+		}
+	}
+
+	return nil
+}
+
+func removeDNSHost(ctx *cli.Context, name string, virsh config.Prog, net *netDumpXML, ip string) error {
+	if len(ip) < 1 {
+		return nil
+	}
+
+	for _, h := range net.DNS.Hosts {
+		if h.IP == ip {
+			return updateNetwork(ctx, name, virsh, "delete", "dns-host", fmt.Sprintf("<host ip='%s'/>", ip))
+		}
+	}
+
+	return nil
+}
+
+func updateHost(ctx *cli.Context, en *config.EnrichedNetwork, virsh config.Prog, command string) error {
+	var host bytes.Buffer
+
+	if err := networkTemplate.ExecuteTemplate(&host, "host", en); err != nil {
+		return err
+	}
+
+	return updateNetwork(ctx, en.Name, virsh, command, "ip-dhcp-host", host.String())
+}
+
+func updateNetwork(ctx *cli.Context, name string, virsh config.Prog, command, section, xml string) error {
+	args := []string{"net-update", name, command, section, xml, "--live"}
+
+	if ctx.Bool("dry-run") {
+		fmt.Println(strings.Join(append([]string{virsh.Name}, args...), " "))
+		return nil
+	}
+
+	if out, err := exec.Command(virsh.Path, args...).CombinedOutput(); err != nil {
+		return cmdError(err, out)
+	}
+
+	return nil
+}
+
+func dnsHost(en *config.EnrichedNetwork) string {
+	return fmt.Sprintf("<host ip='%s'><hostname>%s</hostname></host>", en.IP, en.Hostname)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/c1rcu17/qemuer/config"
+)
+
+// USB devices are matched again when QEMU starts, so they follow the device
+// across replugs as long as it stays on the same id or port.
+func passthroughArgs(ec *config.EnrichedConfig) []string {
+	var args []string
+
+	for _, u := range ec.USB {
+		device := fmt.Sprintf("usb-host,id=%s", u.ID)
+
+		if len(u.Port) > 0 {
+			device += fmt.Sprintf(",hostbus=%s,hostport=%s", u.Bus, u.Port)
+		} else {
+			device += fmt.Sprintf(",vendorid=0x%s,productid=0x%s", u.Vendor, u.Product)
+		}
+
+		args = append(args, "-device", device)
+	}
+
+	for _, p := range ec.PCI {
+		args = append(args, "-device", fmt.Sprintf("vfio-pci,id=%s,host=%s", p.ID, p.Address))
+	}
+
+	return args
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/c1rcu17/qemuer/config"
+)
+
+func TestPassthroughArgs(t *testing.T) {
+	ec := &config.EnrichedConfig{
+		USB: []config.HostUSB{
+			{ID: "hostusb0", Vendor: "046d", Product: "c52b"},
+			{ID: "hostusb1", Device: "1-2.3", Bus: "1", Port: "2.3", Vendor: "1d6b", Product: "0002"},
+		},
+		PCI: []config.HostPCI{
+			{ID: "hostpci0", Address: "0000:01:00.0", IOMMUGroup: "1"},
+		},
+	}
+
+	want := []string{
+		"-device", "usb-host,id=hostusb0,vendorid=0x046d,productid=0xc52b",
+		"-device", "usb-host,id=hostusb1,hostbus=1,hostport=2.3",
+		"-device", "vfio-pci,id=hostpci0,host=0000:01:00.0",
+	}
+
+	if got := passthroughArgs(ec); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if got := passthroughArgs(&config.EnrichedConfig{}); len(got) > 0 {
+		t.Errorf("got %q without devices, want none", got)
+	}
+}
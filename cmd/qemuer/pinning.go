@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+
+	"github.com/c1rcu17/qemuer/config"
+	"github.com/c1rcu17/qemuer/qmp"
+	"github.com/c1rcu17/qemuer/util"
+	"github.com/urfave/cli/v2"
+)
+
+type (
+	cpuInfo struct {
+		CPUIndex int `json:"cpu-index"`
+		ThreadID int `json:"thread-id"`
+	}
+
+	ioThreadInfo struct {
+		ID       string `json:"id"`
+		ThreadID int    `json:"thread-id"`
+	}
+)
+
+// Every QEMU thread starts on the emulator set, then vCPU and I/O threads are
+// moved to their own sets.
+func pinThreads(ctx *cli.Context, ec *config.EnrichedConfig) error {
+	if len(ec.CPU.VCPUPins) < 1 && len(ec.CPU.EmulatorPins) < 1 && len(ec.CPU.IOThreadPins) < 1 {
+		return nil
+	}
+
+	if ctx.Bool("dry-run") {
+		if len(ec.CPU.EmulatorPins) > 0 {
+			fmt.Printf("pin emulator to %v\n", ec.CPU.EmulatorPins)
+		}
+
+		for vcpu := 0; vcpu < ec.CPU.MaxCPUs; vcpu++ {
+			if cpus, ok := ec.CPU.VCPUPins[vcpu]; ok {
+				fmt.Printf("pin vcpu%d to %v\n", vcpu, cpus)
+			}
+		}
+
+		if len(ec.CPU.IOThreadPins) > 0 {
+			fmt.Printf("pin iothreads to %v\n", ec.CPU.IOThreadPins)
+		}
+
+		return nil
+	}
+
+	pid, err := readPIDFile(ec.PIDFile)
+
+	if err != nil {
+		return err
+	}
+
+	m, err := qmp.Dial(ec.QMP, socketTimeout)
+
+	if err != nil {
+		return err
+	}
+
+	defer m.Close()
+
+	if len(ec.CPU.EmulatorPins) > 0 {
+		tasks, err := ioutil.ReadDir(path.Join("/proc", strconv.Itoa(pid), "task"))
+
+		if err != nil {
+			return err
+		}
+
+		for _, t := range tasks {
+			tid, err := strconv.Atoi(t.Name())
+
+			if err != nil {
+				continue
+			}
+
+			if err := util.SetAffinity(tid, ec.CPU.EmulatorPins); err != nil {
+				return fmt.Errorf("pin emulator thread %d: %v", tid, err)
+			}
+		}
+	}
+
+	if len(ec.CPU.VCPUPins) > 0 {
+		if err := pinVCPUs(ec, m); err != nil {
+			return err
+		}
+	}
+
+	if len(ec.CPU.IOThreadPins) > 0 {
+		var threads []ioThreadInfo
+
+		if err := m.Execute("query-iothreads", nil, &threads); err != nil {
+			return err
+		}
+
+		for _, t := range threads {
+			if err := util.SetAffinity(t.ThreadID, ec.CPU.IOThreadPins); err != nil {
+				return fmt.Errorf("pin %s: %v", t.ID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// pinVCPUs also runs after vCPUs are hotplugged, so it pins every vCPU that
+// is present, not only the boot ones
+func pinVCPUs(ec *config.EnrichedConfig, m qmpExecutor) error {
+	var cpus []cpuInfo
+
+	if err := m.Execute("query-cpus-fast", nil, &cpus); err != nil {
+		return err
+	}
+
+	for _, c := range cpus {
+		if pins, ok := ec.CPU.VCPUPins[c.CPUIndex]; ok {
+			if err := util.SetAffinity(c.ThreadID, pins); err != nil {
+				return fmt.Errorf("pin vcpu%d: %v", c.CPUIndex, err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -13,16 +13,46 @@ func main() {
 		&cli.StringFlag{Name: "file", Aliases: []string{"f"}, Required: true, Usage: "name of the `VMFILE`"},
 	}
 
+	MediaFlags := append([]cli.Flag{
+		&cli.IntFlag{Name: "cdrom", Aliases: []string{"c"}, Usage: "`INDEX` of the cd-rom drive"},
+	}, VMFlags...)
+
 	app := &cli.App{
 		Name:  "qemuer",
 		Usage: "launch QEMU virtual machines like if you know how to do it",
 		Commands: []*cli.Command{
+			{Name: "attach", Aliases: []string{"a"}, Usage: "Hotplug a device into the running virtual machine", Subcommands: []*cli.Command{
+				{Name: "disk", Flags: append([]cli.Flag{
+					&cli.StringFlag{Name: "format", Value: "qcow2", Usage: "image `FORMAT`"},
+				}, VMFlags...), ArgsUsage: "PATH", Action: attachDiskCmd, Usage: "Attach the disk image at PATH"},
+				{Name: "nic", Flags: append([]cli.Flag{
+					&cli.StringFlag{Name: "mac", Usage: "`MAC` address, generated when omitted"},
+				}, VMFlags...), ArgsUsage: "NETWORK", Action: attachNICCmd, Usage: "Attach a NIC to the NETWORK index of the VMFILE"},
+				{Name: "cpu", Flags: VMFlags, ArgsUsage: "[COUNT]", Action: attachCPUCmd, Usage: "Attach COUNT vCPUs, up to cpu.maxcpus"},
+			}},
+			{Name: "balloon", Aliases: []string{"b"}, Flags: append([]cli.Flag{
+				&cli.BoolFlag{Name: "watch", Aliases: []string{"w"}, Usage: "keep printing the memory statistics"},
+				&cli.IntFlag{Name: "interval", Aliases: []string{"i"}, Value: 2, Usage: "statistics polling interval in `SECONDS`"},
+			}, VMFlags...), ArgsUsage: "[TARGET]", Action: balloonCmd, Usage: "Set the balloon TARGET memory size or print the guest memory statistics"},
 			{Name: "console", Aliases: []string{"c"}, Flags: VMFlags, Action: consoleCmd, Usage: "Connect to the virtual machine' serial console"},
+			{Name: "detach", Usage: "Unplug a hotplugged device from the running virtual machine", Subcommands: []*cli.Command{
+				{Name: "disk", Flags: VMFlags, ArgsUsage: "ID", Action: detachDiskCmd, Usage: "Detach the disk with ID"},
+				{Name: "nic", Flags: VMFlags, ArgsUsage: "ID", Action: detachNICCmd, Usage: "Detach the NIC with ID"},
+				{Name: "cpu", Flags: VMFlags, ArgsUsage: "[COUNT]", Action: detachCPUCmd, Usage: "Detach the last COUNT hotplugged vCPUs"},
+			}},
 			{Name: "display", Aliases: []string{"d"}, Flags: VMFlags, Action: displayCmd, Usage: "Connect to the virtual machine's QXL display"},
+			{Name: "firmware", Aliases: []string{"fw"}, Action: firmwareCmd, Usage: "List the available firmware"},
 			{Name: "kill", Aliases: []string{"k"}, Flags: VMFlags, Action: killCmd, Usage: "Force shutdown the virtual machine"},
+			{Name: "media", Usage: "Change the media of a cd-rom drive of the running virtual machine", Subcommands: []*cli.Command{
+				{Name: "insert", Flags: MediaFlags, ArgsUsage: "PATH", Action: mediaInsertCmd, Usage: "Insert the ISO image at PATH"},
+				{Name: "eject", Flags: MediaFlags, Action: mediaEjectCmd, Usage: "Eject the media"},
+			}},
 			{Name: "monitor", Aliases: []string{"m"}, Flags: VMFlags, Action: monitorCmd, Usage: "Connect to the virtual machine's QEMU monitor"},
 			{Name: "poweroff", Aliases: []string{"p"}, Flags: VMFlags, Action: poweroffCmd, Usage: "Gracefully shutdown the virtual machine"},
-			{Name: "run", Aliases: []string{"r"}, Flags: VMFlags, Action: runCmd, Usage: "Turn on the virtual machine"},
+			{Name: "run", Aliases: []string{"r"}, Flags: append([]cli.Flag{
+				&cli.StringFlag{Name: "boot-once", Usage: "boot from `DEVICE` this time only, like cdrom, disk, network or cd1"},
+			}, VMFlags...), Action: runCmd, Usage: "Turn on the virtual machine"},
+			{Name: "supervise", Flags: VMFlags, Action: superviseCmd, Hidden: true},
 			{Name: "status", Aliases: []string{"s"}, Flags: VMFlags, Action: statusCmd, Usage: "Print the status of the virtual machine"},
 			{Name: "version", Aliases: []string{"v"}, Action: versionCmd, Usage: "Print the version and exit"},
 		},
@@ -1,143 +1,240 @@
 package main
 
 import (
-	"encoding/xml"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"os"
-	"os/exec"
 	"strconv"
 	"strings"
-	"text/template"
 
 	"github.com/c1rcu17/qemuer/config"
-	"github.com/c1rcu17/qemuer/static"
 	"github.com/urfave/cli/v2"
 )
 
-type netDumpXML struct {
-	Forward struct {
-		Dev string `xml:"dev,attr"`
-	} `xml:"forward"`
-	Bridge struct {
-		Name string `xml:"name,attr"`
-	} `xml:"bridge"`
-	IP struct {
-		Address string `xml:"address,attr"`
-		Netmask string `xml:"netmask,attr"`
-		DHCP    struct {
-			Range struct {
-				Start string `xml:"start,attr"`
-				End   string `xml:"end,attr"`
-			} `xml:"range"`
-		} `xml:"dhcp"`
-	} `xml:"ip"`
-}
-
-var networkTemplate = template.Must(template.New("").Parse(strings.TrimLeft(`
-<network>
-    <name>{{ .Name }}</name>
-    <forward mode='nat'{{ if .NatDev }} dev='{{ .NatDev }}'{{ end }}/>
-    <bridge name='{{ .BridgeDev }}'/>
-    <ip address='{{ .Gateway }}' netmask='{{ .Netmask }}'>
-        <dhcp>
-            <range start='{{ .IPStart }}' end='{{ .IPEnd }}'/>
-        </dhcp>
-    </ip>
-</network>
-`, "\n")))
-
 func runCmd(ctx *cli.Context) error {
-	ec, err := prepareConfig(ctx)
+	ec, err := prepareRun(ctx)
 
 	if err != nil {
 		return err
 	}
 
+	if alive(ec.PID) {
+		return fmt.Errorf("virtual machine %s is already running", ec.Name)
+	}
+
+	if err := ec.CheckHost(sysfsRoot); err != nil {
+		return err
+	}
+
 	if err := os.MkdirAll(ec.Runtime, 0755); err != nil {
 		return err
 	}
 
-	bootIndex := 0
-	bootOrder := ""
-	bootMenu := "off"
+	if err := os.Remove(ec.HotplugFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	started := false
+
+	defer func() {
+		if !started && !ctx.Bool("dry-run") {
+			stopDaemons(ctx, ec)
+		}
+	}()
+
+	once := ctx.String("boot-once")
+
+	if len(once) < 1 {
+		once = ec.Boot.Once
+	}
+
+	bootIndexes, err := ec.BootIndexes(once)
+
+	if err != nil {
+		return fmt.Errorf("boot once: %v", err)
+	}
 
 	qemuArgs := []string{
 		"-name", ec.Name,
-		"-nodefaults", "-no-user-config", "-no-hpet",
-		"-machine", "q35,accel=kvm,vmport=off,dump-guest-core=off"}
+		"-nodefaults", "-no-user-config"}
 
-	if ec.Bios == config.BiosUEFI {
-		if _, err := os.Stat(ec.BiosFile); err != nil {
-			if os.IsNotExist(err) {
-				if err := installBios(ec.BiosFile); err != nil {
-					return err
-				}
-			} else {
+	qemuArgs = append(qemuArgs, machineArgs(ec)...)
+
+	if len(ec.Firmware.Image) > 0 {
+		qemuArgs = append(qemuArgs, "-bios", ec.Firmware.Image)
+	}
+
+	if len(ec.Firmware.Code) > 0 {
+		// The paths are known beforehand, so a dry run leaves them alone
+		if !ctx.Bool("dry-run") {
+			if err := installFirmware(ec); err != nil {
 				return err
 			}
 		}
 
-		qemuArgs = append(qemuArgs, "-bios", ec.BiosFile)
+		qemuArgs = append(qemuArgs,
+			"-drive", fmt.Sprintf("if=pflash,format=%s,unit=0,readonly=on,file=%s", ec.Firmware.Format, ec.Firmware.Code),
+			"-drive", fmt.Sprintf("if=pflash,format=%s,unit=1,file=%s", ec.Firmware.Format, ec.Firmware.Vars))
+
+		if ec.Firmware.SMM {
+			qemuArgs = append(qemuArgs, "-global", "driver=cfi.pflash01,property=secure,value=on")
+		}
+	}
+
+	qemuArgs = append(qemuArgs, "-cpu", strings.Join(append([]string{ec.CPU.Model}, ec.CPU.Features...), ","))
+
+	smp := fmt.Sprintf("cpus=%d,maxcpus=%d,sockets=%d", ec.CPU.Count, ec.CPU.MaxCPUs, ec.CPU.MaxSockets)
+
+	if ec.CPU.Dies > 1 {
+		smp += fmt.Sprintf(",dies=%d", ec.CPU.Dies)
 	}
 
-	qemuArgs = append(qemuArgs, "-cpu", "host",
-		"-smp", fmt.Sprintf("%d,sockets=%d,cores=%d,threads=%d",
-			ec.CPU.Sockets*ec.CPU.Cores*ec.CPU.Threads,
-			ec.CPU.Sockets, ec.CPU.Cores, ec.CPU.Threads),
-		"-m", strconv.Itoa(ec.Memory),
-		"-chardev", fmt.Sprintf("socket,id=char0,path=%s,server,nowait", ec.Console),
-		"-device", "isa-serial,chardev=char0",
+	qemuArgs = append(qemuArgs, "-smp", fmt.Sprintf("%s,cores=%d,threads=%d", smp, ec.CPU.Cores, ec.CPU.Threads))
+	qemuArgs = append(qemuArgs, memoryArgs(ec)...)
+	qemuArgs = append(qemuArgs, "-chardev", fmt.Sprintf("socket,id=char0,path=%s,server,nowait", ec.Console))
+	qemuArgs = append(qemuArgs, serialArgs(ec, "char0")...)
+
+	qemuArgs = append(qemuArgs,
 		"-chardev", fmt.Sprintf("socket,id=char1,path=%s,server,nowait", ec.Monitor),
 		"-mon", "chardev=char1",
+		"-chardev", fmt.Sprintf("socket,id=char7,path=%s,server,nowait", ec.QMP),
+		"-mon", "chardev=char7,mode=control",
 		"-object", "rng-random,id=obj0,filename=/dev/urandom",
-		"-device", "virtio-rng-pci,rng=obj0",
-		"-device", "virtio-balloon-pci",
+		"-device", virtio(ec, "virtio-rng")+",rng=obj0",
+		"-device", balloonDevice(ec),
 		"-pidfile", ec.PIDFile,
 		"-daemonize",
 		"-k", "pt",
 	)
 
-	if len(ec.ISO) > 0 {
-		qemuArgs = append(qemuArgs,
-			"-drive", fmt.Sprintf("id=drive0,if=none,format=raw,file=%s", ec.ISO),
-			"-device", fmt.Sprintf("ide-cd,drive=drive0,bus=ide.1,bootindex=%d", bootIndex))
-		bootIndex++
-		bootOrder = bootOrder + "c"
+	if ec.Machine.Type == config.MachineVirt && len(ec.CDROMs) > 0 {
+		qemuArgs = append(qemuArgs, "-device", "virtio-scsi-pci,id=scsi0")
+	}
+
+	for i, cd := range ec.CDROMs {
+		drive := fmt.Sprintf("id=%s,if=none,media=cdrom,readonly=on", cd.Drive)
+		device := cdromDevice(ec, i) + fmt.Sprintf(",id=%s,drive=%s", cd.ID, cd.Drive)
+
+		if len(cd.ISO) > 0 {
+			drive += fmt.Sprintf(",format=raw,file=%s", cd.ISO)
+		}
+
+		qemuArgs = append(qemuArgs, "-drive", drive, "-device", device+bootIndex(bootIndexes, cd.ID))
+	}
+
+	for i := 0; i < ec.CPU.IOThreads; i++ {
+		qemuArgs = append(qemuArgs, "-object", fmt.Sprintf("iothread,id=iothread%d", i))
 	}
 
 	if len(ec.Disks) > 0 {
 		for i, d := range ec.Disks {
+			if d.Create {
+				if err := run(ctx, ec.Progs.QemuImg, []string{"create", "-q", "-f", "qcow2", d.Path, strconv.FormatInt(int64(d.Size), 10)}); err != nil {
+					return err
+				}
+			}
+
+			iothread := ""
+
+			// Disks are spread over the I/O threads
+			if ec.CPU.IOThreads > 0 {
+				iothread = fmt.Sprintf(",iothread=iothread%d", i%ec.CPU.IOThreads)
+			}
+
 			qemuArgs = append(qemuArgs,
-				"-blockdev", fmt.Sprintf("qcow2,node-name=block%d,file.driver=file,file.filename=%s", i, d),
-				"-device", fmt.Sprintf("virtio-blk-pci,drive=block%d,bootindex=%d", i, bootIndex))
-			bootIndex++
+				"-blockdev", fmt.Sprintf("qcow2,node-name=block%d,file.driver=file,file.filename=%s", i, d.Path),
+				"-device", fmt.Sprintf("%s,id=disk%d,drive=block%d%s%s", virtio(ec, "virtio-blk"), i, i, iothread,
+					bootIndex(bootIndexes, fmt.Sprintf("disk%d", i))))
 		}
-
-		bootOrder = bootOrder + "d"
 	}
 
 	for i, n := range ec.Networks {
-		if err := createNetwork(&n, ec.Progs.Virsh); err != nil {
+		switch n.Mode {
+		case config.NetworkNAT:
+			if err := createNetwork(ctx, &n, ec.Progs.Virsh); err != nil {
+				return err
+			}
+
+			qemuArgs = append(qemuArgs, "-netdev", fmt.Sprintf("bridge,id=net%d,br=%s", i, n.BridgeDev))
+		case config.NetworkIsolated:
+			qemuArgs = append(qemuArgs, "-netdev", fmt.Sprintf("socket,id=net%d,mcast=%s,localaddr=127.0.0.1", i, n.MCast))
+		}
+
+		device := fmt.Sprintf("%s,id=net%d,netdev=net%d,mac=%s", virtio(ec, "virtio-net"), i, i, n.MAC)
+
+		if len(n.ROM) > 0 {
+			device += fmt.Sprintf(",romfile=%s", n.ROM)
+		}
+
+		qemuArgs = append(qemuArgs, "-device", device+bootIndex(bootIndexes, fmt.Sprintf("net%d", i)))
+	}
+
+	if ec.TPM {
+		if err := startSwtpm(ctx, ec); err != nil {
 			return err
 		}
 
+		// SeaBIOS only drives the TIS interface, and virt only has it on sysbus
+		tpmDevice := "tpm-crb"
+
+		switch {
+		case ec.Machine.Type == config.MachineVirt:
+			tpmDevice = "tpm-tis-device"
+		case ec.Bios == config.BiosLegacy:
+			tpmDevice = "tpm-tis"
+		}
+
 		qemuArgs = append(qemuArgs,
-			"-netdev", fmt.Sprintf("bridge,id=net%d,br=%s", i, n.BridgeDev),
-			"-device", fmt.Sprintf("virtio-net-pci,netdev=net%d,mac=%s", i, n.MAC))
+			"-chardev", fmt.Sprintf("socket,id=char6,path=%s", ec.TPMSock),
+			"-tpmdev", "emulator,id=tpm0,chardev=char6",
+			"-device", fmt.Sprintf("%s,tpmdev=tpm0", tpmDevice))
+	}
+
+	for i, sh := range ec.Shares {
+		switch sh.Driver {
+		case config.ShareVirtioFS:
+			if err := startVirtiofsd(ctx, ec, &sh); err != nil {
+				return err
+			}
+
+			qemuArgs = append(qemuArgs,
+				"-chardev", fmt.Sprintf("socket,id=fs%d,path=%s", i, sh.Socket),
+				"-device", fmt.Sprintf("%s,chardev=fs%d,tag=%s", virtio(ec, "vhost-user-fs"), i, sh.Tag))
+		case config.Share9P:
+			readonly := ""
+
+			if sh.ReadOnly {
+				readonly = ",readonly=on"
+			}
+
+			qemuArgs = append(qemuArgs,
+				"-fsdev", fmt.Sprintf("local,id=fsdev%d,path=%s,security_model=passthrough%s", i, sh.Path, readonly),
+				"-device", fmt.Sprintf("%s,fsdev=fsdev%d,mount_tag=%s", virtio(ec, "virtio-9p"), i, sh.Tag))
+		}
+	}
+
+	for i, p := range ec.HotplugPorts {
+		qemuArgs = append(qemuArgs, "-device", fmt.Sprintf("pcie-root-port,id=%s,chassis=%d", p, i+1))
+	}
+
+	if ec.USBController() {
+		qemuArgs = append(qemuArgs, usbArgs(ec)...)
+	}
+
+	qemuArgs = append(qemuArgs, passthroughArgs(ec)...)
+	qemuArgs = append(qemuArgs, usbStorageArgs(ec)...)
+	qemuArgs = append(qemuArgs, inputArgs(ec)...)
+
+	if len(ec.AudioFile) > 0 {
+		if err := os.MkdirAll(ec.State, 0755); err != nil {
+			return err
+		}
 	}
 
+	qemuArgs = append(qemuArgs, audioArgs(ec)...)
+
 	if ec.Video == config.VideoNone {
 		qemuArgs = append(qemuArgs, "-nographic")
 	} else {
-		qemuArgs = append(qemuArgs,
-			"-device", "ich9-usb-ehci1,id=usb",
-			"-device", "ich9-usb-uhci1,masterbus=usb.0,firstport=0,multifunction=on",
-			"-device", "ich9-usb-uhci2,masterbus=usb.0,firstport=2",
-			"-device", "ich9-usb-uhci3,masterbus=usb.0,firstport=4",
-			"-device", "usb-tablet")
-
 		switch ec.Video {
 		case config.VideoQXL:
 			qemuArgs = append(qemuArgs,
@@ -159,83 +256,57 @@ func runCmd(ctx *cli.Context) error {
 		}
 	}
 
-	switch {
-	case bootIndex > 1:
-		bootMenu = "on"
-		fallthrough
-	case bootIndex > 0:
-		qemuArgs = append(qemuArgs, "-boot", fmt.Sprintf("order=%s,menu=%s", bootOrder, bootMenu))
-	}
+	qemuArgs = append(qemuArgs, bootArgs(ec, bootIndexes)...)
 
-	if err := execv(ctx, ec.Progs.Qemu, qemuArgs); err != nil {
+	if err := run(ctx, ec.Progs.Qemu, qemuArgs); err != nil {
 		return err
 	}
 
-	return nil
-}
+	started = true
 
-func createNetwork(en *config.EnrichedNetwork, virsh config.Prog) error {
-	if out, err := exec.Command(virsh.Path, "net-dumpxml", en.Name).CombinedOutput(); err != nil {
-		if !strings.Contains(string(out), "Network not found") {
-			return err
-		}
-	} else {
-		var net netDumpXML
+	if err := spawnSupervisor(ctx, ec); err != nil {
+		return err
+	}
 
-		if err := xml.Unmarshal(out, &net); err != nil {
+	if err := pinThreads(ctx, ec); err != nil {
+		return err
+	}
+
+	if len(once) > 0 {
+		if err := restoreBootOrder(ctx, ec, bootIndexes); err != nil {
 			return err
 		}
+	}
 
-		if net.Forward.Dev == en.NatDev &&
-			net.Bridge.Name == en.BridgeDev &&
-			net.IP.Address == en.Gateway &&
-			net.IP.Netmask == en.Netmask &&
-			net.IP.DHCP.Range.Start == en.IPStart &&
-			net.IP.DHCP.Range.End == en.IPEnd {
-			return nil
-		}
+	return nil
+}
 
-		return fmt.Errorf("network %s exists with different settings", en.Name)
+// Automatic subnets are claimed under a lock that covers both their
+// allocation and persistence, and only by a real run.
+func prepareRun(ctx *cli.Context) (*config.EnrichedConfig, error) {
+	if ctx.Bool("dry-run") {
+		return prepareConfig(ctx)
 	}
 
-	f, err := ioutil.TempFile("", "net-*.xml")
+	unlock, err := config.LockSubnets()
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	defer os.Remove(f.Name())
-
-	if err := networkTemplate.Execute(f, en); err != nil {
-		f.Close()
-		return err
-	}
+	defer unlock()
 
-	f.Close()
+	ec, err := prepareConfig(ctx)
 
-	if err := exec.Command(virsh.Path, "net-create", f.Name()).Run(); err != nil {
-		return err
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
-}
-
-func installBios(path string) error {
-	resource := "/OVMF-pure-efi.fd"
-
-	if src, err := static.OpenResource(resource); err != nil {
-		return err
-	} else {
-		if dst, err := os.Create(path); err != nil {
-			return err
-		} else {
-			defer dst.Close()
-
-			if _, err := io.Copy(dst, src); err != nil {
-				return err
-			}
+	if !alive(ec.PID) {
+		if err := ec.SaveSubnets(); err != nil {
+			return nil, err
 		}
 	}
 
-	return nil
+	return ec, nil
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"path"
+
+	"github.com/c1rcu17/qemuer/config"
+	"github.com/urfave/cli/v2"
+)
+
+func startVirtiofsd(ctx *cli.Context, ec *config.EnrichedConfig, sh *config.EnrichedShare) error {
+	args := []string{"--socket-path=" + sh.Socket, "--shared-dir=" + sh.Path, "--cache=auto"}
+	log := path.Join(ec.Runtime, "virtiofsd.log")
+
+	if sh.ReadOnly {
+		args = append(args, "--readonly")
+	}
+
+	if ctx.Bool("dry-run") {
+		_, err := spawn(ctx, ec.Progs.Virtiofsd, args, log)
+		return err
+	}
+
+	if err := killPIDFile(sh.PIDFile); err != nil {
+		return err
+	}
+
+	if err := os.Remove(sh.Socket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	pid, err := spawn(ctx, ec.Progs.Virtiofsd, args, log)
+
+	if err != nil {
+		return err
+	}
+
+	if err := writePIDFile(sh.PIDFile, pid); err != nil {
+		return err
+	}
+
+	return waitSocket(sh.Socket)
+}
@@ -5,6 +5,7 @@ import (
 	"strings"
 	"text/template"
 
+	"github.com/c1rcu17/qemuer/config"
 	"github.com/urfave/cli/v2"
 )
 
@@ -13,27 +14,119 @@ File:      {{ .File }}
 Home:      {{ .Home }}
 Name:      {{ .Name }}
 Arch:      {{ .Arch }}
-Bios:      {{ .Bios }}{{ if eq .Bios "uefi" }} ({{ .BiosFile }}){{ end }}
-CPU:       {{ .CPU.Sockets }}-{{ .CPU.Cores }}-{{ .CPU.Threads }}
-Memory:    {{ .Memory }} Mb
-ISO:       {{ if .ISO }}{{ .ISO }}{{ else }}-{{ end }}
+Machine:   {{ .Machine.Name }}
+Bios:      {{ .Bios }}{{ if .SecureBoot }} (secure boot){{ end }}
+           Firmware:  {{ .Firmware.Kind }}, {{ .Firmware.Description }}{{ if .Firmware.Descriptor }} ({{ .Firmware.Descriptor }}){{ end }}
+{{- if .Firmware.Image }}
+           Image:     {{ .Firmware.Image }}
+{{- end }}
+{{- if .Firmware.Code }}
+           Code:      {{ .Firmware.Code }}
+           Vars:      {{ .Firmware.Vars }}
+{{- end }}
+CPU:       {{ .CPU.Sockets }}-{{ if gt .CPU.Dies 1 }}{{ .CPU.Dies }}-{{ end }}{{ .CPU.Cores }}-{{ .CPU.Threads }} ({{ .CPU.Count }}{{ if gt .CPU.MaxCPUs .CPU.Count }}, up to {{ .CPU.MaxCPUs }}{{ end }} vCPUs)
+           Model:     {{ .CPU.Model }}{{ range .CPU.Features }} {{ . }}{{ end }}
+{{- if .CPU.IOThreads }}
+           IOThreads: {{ .CPU.IOThreads }}{{ if .CPU.IOThreadPins }} (pinned to {{ .CPU.IOThreadPins }}){{ end }}
+{{- end }}
+{{- range $v, $p := .CPU.VCPUPins }}
+           vCPU {{ $v }}:    {{ $p }}
+{{- end }}
+{{- if .CPU.EmulatorPins }}
+           Emulator:  {{ .CPU.EmulatorPins }}
+{{- end }}
+Memory:    {{ .Memory.Size }}{{ if .Memory.Slots }} (up to {{ .Memory.MaxMem }} in {{ .Memory.Slots }} slots){{ end }}
+{{- if .Memory.Backend }}
+           Backend:   {{ .Memory.Backend }}{{ if .Memory.PageSize }} ({{ .Memory.PageSize }} pages){{ end }}
+{{- if .Memory.Shared }}, shared{{ end }}{{ if .Memory.Prealloc }}, prealloc{{ end }}
+{{- end }}
+{{- if .Memory.FreePageReporting }}
+           Balloon:   free page reporting
+{{- end }}
+{{- range $i, $n := .Memory.NUMA }}
+           Node {{ $i }}:    {{ $n.Memory }}, vCPUs {{ $n.CPUs }}{{ if $n.HostNodes }}, host nodes {{ $n.HostNodes }} ({{ $n.Policy }}){{ end }}
+{{- end }}
+CD-ROMs:   {{ range $i, $c := .CDROMs }}
+{{- if ne $i 0 }}           {{ end }}{{ $c.ID }}: {{ if $c.ISO }}{{ $c.ISO }}{{ else }}empty{{ end }}
+{{ else }}-
+{{ end -}}
 Disks:     {{ range $i, $d := .Disks }}
-{{- if ne $i 0 }}           {{ end }}{{ $d }}
+{{- if ne $i 0 }}           {{ end }}{{ $d.Path }}{{ if $d.Size }} ({{ $d.Size }}{{ if $d.Create }}, not created yet{{ end }}){{ end }}
 {{ end -}}
+Boot:      {{ range $i, $d := .BootOrder }}{{ if $i }}, {{ end }}{{ $d }}{{ else }}-{{ end }}
+{{- if .Boot.Once }} (once: {{ .Boot.Once }}){{ end }}
 Networks:  {{ range $i, $n := .Networks }}
 {{- if ne $i 0 }}
 	   {{ end }}Name:      {{ $n.Name }}
+           Mode:      {{ $n.Mode }}
+           MAC:       {{ $n.MAC }}
+{{- if eq $n.Mode "isolated" }}
+           Segment:   {{ $n.Segment }}
+           MCast:     {{ $n.MCast }}
+{{- else }}
 	   BridgeDev: {{ $n.BridgeDev }}
 	   NatDev:    {{ if $n.NatDev }}{{ $n.NatDev }}{{ else }}-{{ end }}
-           MAC:       {{ $n.MAC }}
            Subnet:    {{ $n.Subnet }}
            Netmask:   {{ $n.Netmask }}
 	   Gateway:   {{ $n.Gateway }}
 	   Broadcast: {{ $n.Broadcast }}
 	   IP Range:  {{ $n.IPStart }} - {{ $n.IPEnd }}
+{{- if or $n.IP $n.Hostname }}
+           Reserved:  {{ if $n.IP }}{{ $n.IP }}{{ else }}-{{ end }}{{ if $n.Hostname }} ({{ $n.Hostname }}){{ end }}
+{{- end }}
+{{- if $n.Subnet6 }}
+           Subnet6:   {{ $n.Subnet6 }}/{{ $n.Prefix6 }}
+           Gateway6:  {{ $n.Gateway6 }}
+           IPv6:      {{ $n.IPv6 }}{{ if $n.IPStart6 }} ({{ $n.IPStart6 }} - {{ $n.IPEnd6 }}){{ end }}
+{{- end }}
+{{- if $n.BootFile }}
+           BootFile:  {{ $n.BootFile }}{{ if $n.BootServer }} (from {{ $n.BootServer }}){{ end }}
+{{- end }}
+{{- if $n.TFTP }}
+           TFTP:      {{ $n.TFTP }}
+{{- end }}
+{{- end }}
+{{- if $n.ROM }}
+           ROM:       {{ $n.ROM }}
+{{- end }}
+{{- if eq $n.Mode "nat" }}
+{{- range $j, $f := $n.PortForwards }}
+           {{ if eq $j 0 }}Forwards:  {{ else }}           {{ end }}host:{{ $f.HostPort }} -> guest:{{ $f.GuestPort }}/{{ $f.Proto }}
+{{- end }}
+{{- end }}
+{{ end -}}
+Shares:    {{ range $i, $s := .Shares }}
+{{- if ne $i 0 }}           {{ end }}{{ $s.Tag }}: {{ $s.Path }} ({{ $s.Driver }}{{ if $s.ReadOnly }}, readonly{{ end }})
+{{ else }}-
+{{ end -}}
+USB:       {{ range $i, $u := .USB }}
+{{- if ne $i 0 }}           {{ end }}{{ $u.ID }}: {{ if $u.Port }}bus {{ $u.Bus }} port {{ $u.Port }}{{ else }}{{ $u.Vendor }}:{{ $u.Product }}{{ end }}
+{{ else }}-
 {{ end -}}
+PCI:       {{ range $i, $p := .PCI }}
+{{- if ne $i 0 }}           {{ end }}{{ $p.ID }}: {{ $p.Address }}
+{{ else }}-
+{{ end -}}
+Hotplug:   {{ if .HotplugPorts }}{{ len .HotplugPorts }} ports{{ else }}-{{ end }}
+{{- range .Plugged.Disks }}
+           {{ .ID }}: {{ .Path }} ({{ .Format }})
+{{- end }}
+{{- range .Plugged.NICs }}
+           {{ .ID }}: network {{ .Network }}, {{ .MAC }}
+{{- end }}
+{{- range .Plugged.CPUs }}
+           {{ . }}: vcpu
+{{- end }}
+TPM:       {{ if .TPM }}{{ .TPMState }} ({{ .TPMSock }}){{ else }}-{{ end }}
 Video:     {{ if ne .Video "none" }}{{ .Video }}{{ else }}-{{ end }}{{ if eq .Video "qxl" }} ({{ .Display }}){{ end }}
+Input:     {{ range $i, $in := .Input }}{{ if $i }}, {{ end }}{{ $in }}{{ else }}-{{ end }}
+Audio:     {{ if ne .Audio "none" }}{{ .Audio }}{{ if .AudioFile }} ({{ .AudioFile }}){{ end }}{{ else }}-{{ end }}
+USB Disks: {{ range $i, $d := .USBStorage }}
+{{- if ne $i 0 }}           {{ end }}{{ $d.ID }}: {{ $d.Path }} ({{ $d.Format }})
+{{ else }}-
+{{ end -}}
 Monitor:   {{ .Monitor }}
+QMP:       {{ .QMP }}
 Console:   {{ .Console }}
 PIDFile:   {{ .PIDFile }}
 PID:       {{ .PID }}
@@ -46,6 +139,11 @@ func statusCmd(ctx *cli.Context) error {
 		return err
 	}
 
+	// The supervisor may not be there to remove the devices of a stopped VM
+	if !alive(ec.PID) {
+		ec.Plugged = config.HotplugState{}
+	}
+
 	if err := statusTemplate.Execute(os.Stdout, ec); err != nil {
 		return err
 	}
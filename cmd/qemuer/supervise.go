@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/c1rcu17/qemuer/config"
+	"github.com/urfave/cli/v2"
+)
+
+const supervisePeriod = time.Second
+
+// needsSupervisor tells whether the VM has anything to set up while it runs
+// or to tear down once it stops
+func needsSupervisor(ec *config.EnrichedConfig) bool {
+	if ec.TPM {
+		return true
+	}
+
+	for _, sh := range ec.Shares {
+		if sh.Driver == config.ShareVirtioFS {
+			return true
+		}
+	}
+
+	for _, n := range ec.Networks {
+		if len(n.PortForwards) > 0 || len(n.IP) > 0 || len(n.Hostname) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func spawnSupervisor(ctx *cli.Context, ec *config.EnrichedConfig) error {
+	if !needsSupervisor(ec) {
+		return nil
+	}
+
+	self, err := os.Executable()
+
+	if err != nil {
+		return err
+	}
+
+	prog := config.Prog{Name: path.Base(os.Args[0]), Path: self}
+
+	if _, err := spawn(ctx, prog, []string{"supervise", "-f", ec.File}, path.Join(ec.Runtime, "supervisor.log")); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func superviseCmd(ctx *cli.Context) error {
+	ec, err := prepareConfig(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	if !alive(ec.PID) {
+		return fmt.Errorf("virtual machine %s is not running", ec.Name)
+	}
+
+	fw := newForwarder(ec)
+
+	for alive(ec.PID) {
+		if err := fw.update(); err != nil {
+			fmt.Fprintln(os.Stderr, "forwards:", err)
+		}
+
+		time.Sleep(supervisePeriod)
+	}
+
+	stopDaemons(ctx, ec)
+
+	if err := os.Remove(ec.HotplugFile); err != nil && !os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, "hotplug:", err)
+	}
+
+	if err := fw.close(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func stopDaemons(ctx *cli.Context, ec *config.EnrichedConfig) {
+	if len(ec.TPMPID) > 0 {
+		if err := killPIDFile(ec.TPMPID); err != nil {
+			fmt.Fprintln(os.Stderr, "swtpm:", err)
+		}
+	}
+
+	for _, sh := range ec.Shares {
+		if len(sh.PIDFile) > 0 {
+			if err := killPIDFile(sh.PIDFile); err != nil {
+				fmt.Fprintln(os.Stderr, "virtiofsd:", err)
+			}
+		}
+	}
+
+	for _, n := range ec.Networks {
+		if n.Mode == config.NetworkNAT {
+			if err := releaseHost(ctx, &n, ec.Progs.Virsh); err != nil {
+				fmt.Fprintln(os.Stderr, "network:", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"path"
+
+	"github.com/c1rcu17/qemuer/config"
+	"github.com/urfave/cli/v2"
+)
+
+func startSwtpm(ctx *cli.Context, ec *config.EnrichedConfig) error {
+	args := []string{"socket", "--tpm2",
+		"--tpmstate", "dir=" + ec.TPMState + ",mode=0600",
+		"--ctrl", "type=unixio,path=" + ec.TPMSock,
+		"--terminate"}
+	log := path.Join(ec.Runtime, "swtpm.log")
+
+	if ctx.Bool("dry-run") {
+		_, err := spawn(ctx, ec.Progs.Swtpm, args, log)
+		return err
+	}
+
+	if err := os.MkdirAll(ec.TPMState, 0700); err != nil {
+		return err
+	}
+
+	if err := killPIDFile(ec.TPMPID); err != nil {
+		return err
+	}
+
+	if err := os.Remove(ec.TPMSock); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	pid, err := spawn(ctx, ec.Progs.Swtpm, args, log)
+
+	if err != nil {
+		return err
+	}
+
+	if err := writePIDFile(ec.TPMPID, pid); err != nil {
+		return err
+	}
+
+	return waitSocket(ec.TPMSock)
+}
@@ -1,5 +1,3 @@
-//go:generate ./versiongen.sh
-
 package main
 
 import (
@@ -10,6 +8,9 @@ import (
 	"github.com/urfave/cli/v2"
 )
 
+// Set at link time by the Makefile
+var versionNumber = "devel"
+
 func versionCmd(ctx *cli.Context) error {
 	fmt.Println(path.Base(os.Args[0]), versionNumber)
 	return nil
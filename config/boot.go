@@ -0,0 +1,234 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+const (
+	bootCDROM   = "cdrom"
+	bootDisk    = "disk"
+	bootNetwork = "network"
+)
+
+var bootDeviceRegexp = regexp.MustCompile(`^(cd|disk|net)(\d+)$`)
+
+// Distributions ship the iPXE option ROMs in different places
+var romDirs = []string{"/usr/share/qemu", "/usr/share/qemu-kvm", "/usr/share/ipxe/qemu", "/usr/lib/ipxe/qemu"}
+
+func (b *Boot) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value interface{}
+
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+
+	if _, ok := value.(map[interface{}]interface{}); !ok {
+		var device string
+
+		if err := unmarshal(&device); err != nil {
+			return err
+		}
+
+		// A single device boots first, and falls back to the default order,
+		// whose classes skip it
+		*b = Boot{Order: []string{device, bootCDROM, bootDisk}}
+
+		return nil
+	}
+
+	type plain Boot
+
+	return unmarshal((*plain)(b))
+}
+
+func enrichBoot(ec *EnrichedConfig) error {
+	if ec.Boot.SplashTime < 0 || ec.Boot.SplashTime > 0xffff {
+		return fmt.Errorf("boot.splashtime must be between 0 and %d milliseconds", 0xffff)
+	}
+
+	order := ec.Boot.Order
+
+	if len(order) < 1 {
+		order = []string{bootCDROM, bootDisk}
+	}
+
+	devices, err := bootDevices(ec, order)
+
+	if err != nil {
+		return fmt.Errorf("boot.order: %v", err)
+	}
+
+	ec.BootOrder = devices
+
+	if err := enrichROMs(ec); err != nil {
+		return err
+	}
+
+	if len(ec.Boot.Once) > 0 {
+		if _, err := ec.BootIndexes(ec.Boot.Once); err != nil {
+			return fmt.Errorf("boot.once: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// BootIndexes maps device ids to their bootindex, with the once device, if
+// any, booting first.
+func (ec *EnrichedConfig) BootIndexes(once string) (map[string]int, error) {
+	order := ec.BootOrder
+
+	if len(once) > 0 {
+		first, err := bootDevices(ec, []string{once})
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(first) < 1 {
+			return nil, fmt.Errorf("no bootable %s device", once)
+		}
+
+		order = first
+
+		for _, d := range ec.BootOrder {
+			if !contains(first, d) {
+				order = append(order, d)
+			}
+		}
+	}
+
+	indexes := map[string]int{}
+
+	for i, d := range order {
+		indexes[d] = i
+	}
+
+	return indexes, nil
+}
+
+// Device classes expand to every device of the class not listed before, so
+// a device can go ahead of the rest of its class, except for cd-rom drives
+// that start empty.
+func bootDevices(ec *EnrichedConfig, order []string) ([]string, error) {
+	devices := []string{}
+	explicit := []string{}
+
+	add := func(d string) {
+		if !contains(devices, d) {
+			devices = append(devices, d)
+		}
+	}
+
+	for _, o := range order {
+		switch o {
+		case bootCDROM:
+			for _, cd := range ec.CDROMs {
+				if len(cd.ISO) > 0 {
+					add(cd.ID)
+				}
+			}
+		case bootDisk:
+			for i := range ec.Disks {
+				add(fmt.Sprintf("disk%d", i))
+			}
+		case bootNetwork:
+			if len(ec.Networks) < 1 {
+				return nil, fmt.Errorf("no networks to boot from")
+			}
+
+			for i := range ec.Networks {
+				add(fmt.Sprintf("net%d", i))
+			}
+		default:
+			m := bootDeviceRegexp.FindStringSubmatch(o)
+
+			if m == nil {
+				return nil, fmt.Errorf("invalid boot device %s, choose from: %v or a device like cd0, disk1, net0",
+					o, []string{bootCDROM, bootDisk, bootNetwork})
+			}
+
+			index, _ := strconv.Atoi(m[2])
+			count := map[string]int{"cd": len(ec.CDROMs), "disk": len(ec.Disks), "net": len(ec.Networks)}[m[1]]
+
+			if index >= count {
+				return nil, fmt.Errorf("no boot device %s", o)
+			}
+
+			if contains(explicit, o) {
+				return nil, fmt.Errorf("%s listed more than once", o)
+			}
+
+			if contains(devices, o) {
+				return nil, fmt.Errorf("%s is already listed by its class, move it ahead of it", o)
+			}
+
+			explicit = append(explicit, o)
+			devices = append(devices, o)
+		}
+	}
+
+	return devices, nil
+}
+
+// NICs that may boot on x86 PCI machines get the iPXE option ROM, unless the
+// VMFILE points them to a custom one.
+func enrichROMs(ec *EnrichedConfig) error {
+	for i := range ec.Networks {
+		n := &ec.Networks[i]
+
+		if len(n.ROMFile) > 0 {
+			if !ec.Machine.PCI() {
+				return fmt.Errorf("romfile %s: not supported by machine %s", n.ROMFile, ec.Machine.Type)
+			}
+
+			n.ROM = n.ROMFile
+
+			if !filepath.IsAbs(n.ROM) {
+				n.ROM = path.Join(ec.Home, n.ROM)
+			}
+
+			if _, err := os.Stat(n.ROM); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if !ec.Machine.PCI() || !ec.Machine.X86() {
+			continue
+		}
+
+		n.ROM = findROM(ec.Bios)
+
+		if len(n.ROM) < 1 && contains(ec.BootOrder, fmt.Sprintf("net%d", i)) {
+			return fmt.Errorf("net%d: no iPXE rom found in %v, install it or set romfile", i, romDirs)
+		}
+	}
+
+	return nil
+}
+
+// The EFI ROMs also carry the legacy PXE image
+func findROM(bios Bios) string {
+	roms := []string{"efi-virtio.rom"}
+
+	if bios == BiosLegacy {
+		roms = append(roms, "pxe-virtio.rom")
+	}
+
+	for _, rom := range roms {
+		for _, dir := range romDirs {
+			if _, err := os.Stat(path.Join(dir, rom)); err == nil {
+				return path.Join(dir, rom)
+			}
+		}
+	}
+
+	return ""
+}
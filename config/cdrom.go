@@ -0,0 +1,68 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// A single path is accepted as a one element list
+func (p *Paths) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single string
+
+	if err := unmarshal(&single); err == nil {
+		*p = Paths{single}
+		return nil
+	}
+
+	var list []string
+
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+
+	*p = list
+
+	return nil
+}
+
+// Drives without an ISO start empty, so media can be inserted while running
+func enrichCDROMs(ec *EnrichedConfig) error {
+	limits := map[MachineType]int{MachineQ35: 6, MachinePC: 4, MachineVirt: 8}
+	count := len(ec.ISO)
+
+	if ec.Config.CDROMs != nil {
+		count = *ec.Config.CDROMs
+	} else if count < 1 && ec.Machine.Type != MachineMicroVM {
+		count = 1
+	}
+
+	if count < len(ec.ISO) {
+		return fmt.Errorf("cdroms must be at least %d, one per iso", len(ec.ISO))
+	}
+
+	if count > limits[ec.Machine.Type] {
+		return fmt.Errorf("cdroms must be at most %d on machine %s", limits[ec.Machine.Type], ec.Machine.Type)
+	}
+
+	for i := 0; i < count; i++ {
+		cd := CDROM{ID: fmt.Sprintf("cd%d", i), Drive: fmt.Sprintf("drive%d", i)}
+
+		if i < len(ec.ISO) {
+			cd.ISO = ec.ISO[i]
+
+			if !filepath.IsAbs(cd.ISO) {
+				cd.ISO = path.Join(ec.Home, cd.ISO)
+			}
+
+			if _, err := os.Stat(cd.ISO); err != nil {
+				return err
+			}
+		}
+
+		ec.CDROMs = append(ec.CDROMs, cd)
+	}
+
+	return nil
+}
@@ -4,69 +4,260 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
-	"net"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
-
-	"github.com/c1rcu17/qemuer/util"
 )
 
 type (
 	Config struct {
-		Name     string
-		Arch     Arch
-		Bios     Bios
-		CPU      CPU
-		Memory   int
-		ISO      string
-		Disks    []string
-		Networks []Network
-		Video    Video
+		Name       string
+		Arch       Arch
+		Machine    string
+		Bios       Bios
+		CPU        CPU
+		Memory     Memory
+		ISO        Paths
+		CDROMs     *int
+		Disks      []Disk
+		Networks   []Network
+		Shares     []Share
+		USB        []string
+		PCI        []string
+		Hotplug    int
+		TPM        bool
+		SecureBoot bool
+		Firmware   string
+		Boot       Boot
+		Video      Video
+		Input      []Input
+		Audio      Audio
+		USBStorage Paths
 	}
 
-	Arch string
-	Bios string
+	Arch        string
+	MachineType string
+	Bios        string
 
 	CPU struct {
-		Sockets, Cores, Threads int
+		Model, Flags                  string
+		Sockets, Dies, Cores, Threads int
+		MaxCPUs, IOThreads            int
+		Nested                        *bool
+		Pinning                       Pinning
+	}
+
+	Pinning struct {
+		VCPUs               map[int]string
+		Emulator, IOThreads string
 	}
 
 	Network struct {
-		NatDev, MAC, CIDR string
+		Name                     string
+		Mode                     NetworkMode
+		NatDev, MAC, CIDR, CIDR6 string
+		IP, Hostname, Segment    string
+		IPv6                     IPv6Mode
+		Forwards                 []string
+		TFTP, BootFile           string
+		BootServer, ROMFile      string
 	}
 
+	NetworkMode string
+
+	IPv6Mode string
+
+	Paths []string
+
+	Boot struct {
+		Order      []string
+		Menu       *bool
+		SplashTime int
+		Once       string
+	}
+
+	Disk struct {
+		Path string
+		Size Size
+	}
+
+	Memory struct {
+		Size, PageSize    Size
+		Backend           MemoryBackend
+		Shared, Prealloc  bool
+		FreePageReporting bool
+		Slots             int
+		MaxMem            Size
+		NUMA              []NUMANode
+	}
+
+	MemoryBackend string
+
+	NUMANode struct {
+		CPUs, HostNodes string
+		Memory          Size
+		Policy          NUMAPolicy
+	}
+
+	NUMAPolicy string
+
+	Share struct {
+		Path, Tag string
+		ReadOnly  bool
+		Driver    ShareDriver
+	}
+
+	ShareDriver string
+
 	Video string
 
+	Input string
+
+	Audio string
+
 	EnrichedConfig struct {
 		Config
-		Networks []EnrichedNetwork
-		File     string
-		Home     string
-		Runtime  string
-		Monitor  string
-		Console  string
-		Display  string
-		PIDFile  string
-		BiosFile string
-		PID      int
-		Progs    Progs
+		Machine      Machine
+		CPU          EnrichedCPU
+		Memory       EnrichedMemory
+		Disks        []EnrichedDisk
+		CDROMs       []CDROM
+		BootOrder    []string
+		Networks     []EnrichedNetwork
+		Shares       []EnrichedShare
+		USB          []HostUSB
+		PCI          []HostPCI
+		USBStorage   []USBDrive
+		AudioFile    string
+		ID           string
+		File         string
+		Home         string
+		State        string
+		Runtime      string
+		Monitor      string
+		QMP          string
+		Console      string
+		Display      string
+		PIDFile      string
+		HotplugFile  string
+		HotplugPorts []string
+		Plugged      HotplugState
+		Firmware     Firmware
+		TPMState     string
+		TPMSock      string
+		TPMPID       string
+		PID          int
+		Progs        Progs
 	}
 
 	EnrichedNetwork struct {
 		Network
 		Name, BridgeDev, Subnet, Netmask, Gateway, Broadcast, IPStart, IPEnd string
+		Subnet6, Gateway6, IPStart6, IPEnd6                                  string
+		Prefix6                                                              int
+		MCast                                                                string
+		PortForwards                                                         []PortForward
+		SubnetKey                                                            string
+		ROM                                                                  string
+	}
+
+	PortForward struct {
+		Proto               string
+		HostPort, GuestPort int
+	}
+
+	EnrichedCPU struct {
+		CPU
+		Features          []string
+		Count, MaxSockets int
+		VCPUPins          map[int][]int
+		EmulatorPins      []int
+		IOThreadPins      []int
+	}
+
+	HotplugState struct {
+		Disks []HotplugDisk
+		NICs  []HotplugNIC
+		CPUs  []string
+	}
+
+	HotplugDisk struct {
+		ID, Path, Format, Port string
+	}
+
+	HotplugNIC struct {
+		ID      string
+		Network int
+		MAC     string
+		Port    string
+	}
+
+	HostUSB struct {
+		ID, Device, Vendor, Product string
+		Bus, Port                   string
+	}
+
+	HostPCI struct {
+		ID, Address, IOMMUGroup string
+	}
+
+	USBDrive struct {
+		ID, Drive, Path, Format string
+	}
+
+	CDROM struct {
+		ID, Drive, ISO string
+	}
+
+	EnrichedDisk struct {
+		Disk
+		Create bool
+	}
+
+	EnrichedMemory struct {
+		Memory
+		NUMA []EnrichedNUMANode
+	}
+
+	EnrichedNUMANode struct {
+		NUMANode
+		CPUSet, HostNodeSet []int
+	}
+
+	Machine struct {
+		Type          MachineType
+		Name, Version string
+	}
+
+	Firmware struct {
+		Kind                     FirmwareKind
+		Description, Descriptor  string
+		Image                    string
+		Code, VarsTemplate, Vars string
+		Format                   string
+		Embedded, SMM            bool
+	}
+
+	FirmwareKind string
+
+	EnrichedShare struct {
+		Share
+		Socket, PIDFile string
 	}
 
 	Progs struct {
-		Qemu    Prog
-		Virsh   Prog
-		Minicom Prog
-		Spicy   Prog
-		Socat   Prog
+		Qemu      Prog
+		Virsh     Prog
+		Minicom   Prog
+		Spicy     Prog
+		Socat     Prog
+		Nft       Prog
+		Virtiofsd Prog
+		Swtpm     Prog
+		QemuImg   Prog
 	}
 
 	Prog struct {
@@ -76,17 +267,57 @@ type (
 )
 
 const (
-	ArchX8664   Arch  = "x86_64"
-	BiosLegacy  Bios  = "legacy"
-	BiosUEFI    Bios  = "uefi"
-	VideoNone   Video = "none"
-	VideoQXL    Video = "qxl"
-	VideoVGA    Video = "vga"
-	VideoVirtIO Video = "virtio"
+	ArchX8664           Arch          = "x86_64"
+	ArchAArch64         Arch          = "aarch64"
+	MachineQ35          MachineType   = "q35"
+	MachinePC           MachineType   = "pc"
+	MachineMicroVM      MachineType   = "microvm"
+	MachineVirt         MachineType   = "virt"
+	BiosLegacy          Bios          = "legacy"
+	BiosUEFI            Bios          = "uefi"
+	FirmwareSeaBIOS     FirmwareKind  = "seabios"
+	FirmwareOVMF        FirmwareKind  = "ovmf"
+	FirmwareOVMFSecBoot FirmwareKind  = "ovmf-secboot"
+	FirmwareCustom      FirmwareKind  = "custom"
+	CIDRAuto                          = "auto"
+	MACAuto                           = "auto"
+	NetworkNAT          NetworkMode   = "nat"
+	NetworkIsolated     NetworkMode   = "isolated"
+	MemoryRAM           MemoryBackend = "ram"
+	MemoryMemFD         MemoryBackend = "memfd"
+	MemoryHugePages     MemoryBackend = "hugepages"
+	NUMAPreferred       NUMAPolicy    = "preferred"
+	NUMABind            NUMAPolicy    = "bind"
+	NUMAInterleave      NUMAPolicy    = "interleave"
+	ShareVirtioFS       ShareDriver   = "virtiofs"
+	Share9P             ShareDriver   = "9p"
+	IPv6DHCP            IPv6Mode      = "dhcp"
+	IPv6SLAAC           IPv6Mode      = "slaac"
+	VideoNone           Video         = "none"
+	VideoQXL            Video         = "qxl"
+	VideoVGA            Video         = "vga"
+	VideoVirtIO         Video         = "virtio"
+	InputKeyboard       Input         = "keyboard"
+	InputMouse          Input         = "mouse"
+	InputTablet         Input         = "tablet"
+	InputVirtIOKeyboard Input         = "virtio-keyboard"
+	InputVirtIOMouse    Input         = "virtio-mouse"
+	InputVirtIOTablet   Input         = "virtio-tablet"
+	AudioNone           Audio         = "none"
+	AudioWAV            Audio         = "wav"
+	AudioPipeWire       Audio         = "pipewire"
 )
 
 func (p *Prog) Which() error {
 	if path, err := exec.LookPath(p.Name); err != nil {
+		// Some helpers are installed outside of PATH
+		for _, dir := range []string{"/usr/libexec", "/usr/lib/qemu"} {
+			if path, err := exec.LookPath(filepath.Join(dir, p.Name)); err == nil {
+				p.Path = path
+				return nil
+			}
+		}
+
 		return err
 	} else {
 		p.Path = path
@@ -98,10 +329,10 @@ func (p *Prog) Which() error {
 func NewConfig() *Config {
 	return &Config{
 		Arch:   ArchX8664,
-		Bios:   BiosUEFI,
 		CPU:    CPU{Sockets: 1, Cores: 2, Threads: 1},
-		Memory: 1024,
+		Memory: Memory{Size: 1 * GiB},
 		Video:  VideoNone,
+		Audio:  AudioNone,
 	}
 }
 
@@ -115,60 +346,40 @@ func NewEnrichedConfig(c *Config, file string) (*EnrichedConfig, error) {
 	}
 
 	ec.Home = filepath.Dir(ec.File)
+	ec.State = ec.File + ".state"
 
 	if len(ec.Name) < 1 {
 		return nil, fmt.Errorf("name field cannot be empty")
 	}
 
 	switch ec.Arch {
-	case ArchX8664:
-		ec.Progs.Qemu.Name = "qemu-system-x86_64"
+	case ArchX8664, ArchAArch64:
+		ec.Progs.Qemu.Name = fmt.Sprintf("qemu-system-%s", ec.Arch)
 	default:
-		return nil, fmt.Errorf("invalid arch %s, choose from: %v", ec.Arch, []Arch{ArchX8664})
+		return nil, fmt.Errorf("invalid arch %s, choose from: %v", ec.Arch, []Arch{ArchX8664, ArchAArch64})
+	}
+
+	if err := enrichMachine(ec); err != nil {
+		return nil, err
 	}
 
 	switch ec.Bios {
-	case BiosLegacy, BiosUEFI:
+	case "", BiosLegacy, BiosUEFI:
 	default:
 		return nil, fmt.Errorf("invalid bios %s, choose from: %v", ec.Bios, []Bios{BiosLegacy, BiosUEFI})
 
 	}
 
-	if ec.CPU.Sockets < 1 {
-		return nil, fmt.Errorf("cpu.sockets must be greater than 1")
-	}
-
-	if ec.CPU.Cores < 1 {
-		return nil, fmt.Errorf("cpu.cores must be greater than 1")
-	}
-
-	if ec.CPU.Threads < 1 {
-		return nil, fmt.Errorf("cpu.threads must be greater than 1")
-	}
-
-	if ec.Memory < 64 {
-		return nil, fmt.Errorf("memory must be greater than 64")
+	if err := enrichCPU(ec); err != nil {
+		return nil, err
 	}
 
-	if len(ec.ISO) > 0 {
-		if !filepath.IsAbs(ec.ISO) {
-			ec.ISO = path.Join(ec.Home, ec.ISO)
-		}
-
-		if _, err := os.Stat(ec.ISO); err != nil {
-			return nil, err
-		}
+	if err := enrichCDROMs(ec); err != nil {
+		return nil, err
 	}
 
-	for i, d := range ec.Disks {
-		if !filepath.IsAbs(d) {
-			d = path.Join(ec.Home, d)
-			ec.Disks[i] = d
-		}
-
-		if _, err := os.Stat(d); err != nil {
-			return nil, err
-		}
+	if err := enrichDisks(ec); err != nil {
+		return nil, err
 	}
 
 	if err := enrichNetworks(ec); err != nil {
@@ -181,14 +392,24 @@ func NewEnrichedConfig(c *Config, file string) (*EnrichedConfig, error) {
 		return nil, fmt.Errorf("invalid video %s, choose from: %v", ec.Video, []Video{VideoNone, VideoQXL, VideoVGA, VideoVirtIO})
 	}
 
-	id := fmt.Sprintf("%x", sha256.Sum256([]byte(ec.File)))[:8]
-	ec.Runtime = path.Join("/var/run/qemuer", id)
+	ec.ID = fmt.Sprintf("%x", sha256.Sum256([]byte(ec.File)))[:8]
+	ec.Runtime = path.Join("/var/run/qemuer", ec.ID)
 	ec.Monitor = path.Join(ec.Runtime, "monitor.sock")
+	ec.QMP = path.Join(ec.Runtime, "qmp.sock")
 	ec.Console = path.Join(ec.Runtime, "console.sock")
 	ec.Display = path.Join(ec.Runtime, "display.sock")
-	ec.BiosFile = path.Join(ec.Runtime, "bios.bin")
 	ec.PIDFile = path.Join(ec.Runtime, "qemu.pid")
 
+	if err := enrichFirmware(ec); err != nil {
+		return nil, err
+	}
+
+	if ec.TPM {
+		ec.TPMState = path.Join(ec.State, "tpm")
+		ec.TPMSock = path.Join(ec.Runtime, "swtpm.sock")
+		ec.TPMPID = path.Join(ec.Runtime, "swtpm.pid")
+	}
+
 	if pid, err := ioutil.ReadFile(ec.PIDFile); err != nil {
 		if !os.IsNotExist(err) {
 			return nil, err
@@ -201,102 +422,74 @@ func NewEnrichedConfig(c *Config, file string) (*EnrichedConfig, error) {
 		}
 	}
 
-	ec.Progs.Virsh.Name = "virsh"
-	ec.Progs.Minicom.Name = "minicom"
-	ec.Progs.Spicy.Name = "spicy"
-	ec.Progs.Socat.Name = "socat"
-
-	for _, p := range []*Prog{&ec.Progs.Qemu, &ec.Progs.Virsh, &ec.Progs.Minicom, &ec.Progs.Spicy, &ec.Progs.Socat} {
-		if err := p.Which(); err != nil {
-			return nil, err
-		}
+	if err := enrichShares(ec); err != nil {
+		return nil, err
 	}
 
-	return ec, nil
-}
-
-func enrichNetworks(ec *EnrichedConfig) error {
-	var interfaces []string
-	var macs []string
-
-	if ifaces, err := net.Interfaces(); err != nil {
-		return err
-	} else {
-		for _, i := range ifaces {
-			interfaces = append(interfaces, i.Name)
-
-			if i.HardwareAddr != nil {
-				macs = append(macs, i.HardwareAddr.String())
-			}
-		}
+	if err := enrichBoot(ec); err != nil {
+		return nil, err
 	}
 
-	for _, n := range ec.Config.Networks {
-		en := EnrichedNetwork{Network: n}
-
-		if mac, err := net.ParseMAC(en.MAC); err != nil {
-			return err
-		} else {
-			if len(en.NatDev) > 0 {
-				for i, iface := range interfaces {
-					if en.NatDev == iface {
-						break
-					}
-					if i == len(interfaces)-1 {
-						return fmt.Errorf("invalid natdev %s, choose from: %v", en.NatDev, interfaces)
-					}
-				}
-			}
+	if err := enrichHotplug(ec); err != nil {
+		return nil, err
+	}
 
-			en.MAC = mac.String()
+	if err := enrichPassthrough(ec); err != nil {
+		return nil, err
+	}
 
-			for _, m := range macs {
-				if en.MAC == m {
-					return fmt.Errorf("address %s: already in use", en.MAC)
-				}
-			}
+	if err := enrichDevices(ec); err != nil {
+		return nil, err
+	}
 
-			macs = append(macs, en.MAC)
+	if err := enrichMemory(ec); err != nil {
+		return nil, err
+	}
 
-			first_byte := mac[0]
+	ec.Progs.Virsh.Name = "virsh"
+	ec.Progs.Minicom.Name = "minicom"
+	ec.Progs.Spicy.Name = "spicy"
+	ec.Progs.Socat.Name = "socat"
+	ec.Progs.Nft.Name = "nft"
+	ec.Progs.Swtpm.Name = "swtpm"
+	ec.Progs.QemuImg.Name = "qemu-img"
 
-			if first_byte&0b01 != 0 {
-				return fmt.Errorf("address %s: is a multicast MAC address. see: "+
-					"https://en.wikipedia.org/wiki/MAC_address#Unicast_vs._multicast", en.MAC)
-			}
+	progs := []*Prog{&ec.Progs.Qemu, &ec.Progs.Minicom, &ec.Progs.Spicy, &ec.Progs.Socat}
 
-			if first_byte&0b10 == 0 {
-				return fmt.Errorf("address %s: is a universally administered MAC address (UAA). see: "+
-					"https://en.wikipedia.org/wiki/MAC_address#Universal_vs._local", en.MAC)
-			}
+	for _, n := range ec.Networks {
+		if n.Mode == NetworkNAT {
+			progs = append(progs, &ec.Progs.Virsh)
+			break
 		}
+	}
 
-		if addr, subnet, err := net.ParseCIDR(en.CIDR); err != nil {
-			return err
-		} else {
-			en.Subnet = subnet.IP.String()
-			en.Netmask = net.IP(subnet.Mask).String()
+	for _, n := range ec.Networks {
+		if len(n.PortForwards) > 0 {
+			progs = append(progs, &ec.Progs.Nft)
+			break
+		}
+	}
 
-			if !addr.Equal(subnet.IP) {
-				return fmt.Errorf("invalid subnet address %s: it should be %s", addr, en.Subnet)
-			}
+	if ec.TPM {
+		progs = append(progs, &ec.Progs.Swtpm)
+	}
 
-			if gw, bc, start, end, err := util.AddressRange(subnet); err != nil {
-				return err
-			} else {
-				en.Gateway = gw.String()
-				en.Broadcast = bc.String()
-				en.IPStart = start.String()
-				en.IPEnd = end.String()
-			}
+	for _, d := range ec.Disks {
+		if d.Create {
+			progs = append(progs, &ec.Progs.QemuImg)
+			break
 		}
+	}
 
-		id := fmt.Sprintf("%x", sha256.Sum256([]byte(en.Subnet+en.Netmask)))[:8]
-		en.Name = fmt.Sprintf("net-%s", id)
-		en.BridgeDev = fmt.Sprintf("br-%s", id)
+	for _, p := range progs {
+		if err := p.Which(); err != nil {
+			return nil, err
+		}
+	}
 
-		ec.Networks = append(ec.Networks, en)
+	if err := checkCPUModel(ec); err != nil {
+		return nil, err
 	}
 
-	return nil
+	return ec, nil
 }
@@ -0,0 +1,294 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/c1rcu17/qemuer/util"
+)
+
+const cpuModelHost = "host"
+
+var cpuFlagRegexp = regexp.MustCompile(`^([+-])([a-z0-9][a-z0-9_.-]*)$`)
+
+func enrichCPU(ec *EnrichedConfig) error {
+	c := ec.Config.CPU
+	ec.CPU = EnrichedCPU{CPU: c}
+
+	if len(c.Model) < 1 {
+		ec.CPU.Model = cpuModelHost
+	}
+
+	if c.Sockets < 1 {
+		return fmt.Errorf("cpu.sockets must be greater than 1")
+	}
+
+	if c.Dies < 1 {
+		ec.CPU.Dies = 1
+	} else if c.Dies > 1 && ec.Arch != ArchX8664 {
+		return fmt.Errorf("cpu.dies is not supported by arch %s", ec.Arch)
+	}
+
+	if c.Cores < 1 {
+		return fmt.Errorf("cpu.cores must be greater than 1")
+	}
+
+	if c.Threads < 1 {
+		return fmt.Errorf("cpu.threads must be greater than 1")
+	}
+
+	perSocket := ec.CPU.Dies * c.Cores * c.Threads
+	ec.CPU.Count = c.Sockets * perSocket
+	ec.CPU.MaxSockets = c.Sockets
+
+	// vCPUs are hotplugged a socket at a time
+	if c.MaxCPUs > 0 {
+		if c.MaxCPUs < ec.CPU.Count {
+			return fmt.Errorf("cpu.maxcpus must be at least %d", ec.CPU.Count)
+		}
+
+		if c.MaxCPUs%perSocket != 0 {
+			return fmt.Errorf("cpu.maxcpus must be a multiple of %d (dies * cores * threads)", perSocket)
+		}
+
+		ec.CPU.MaxSockets = c.MaxCPUs / perSocket
+	}
+
+	ec.CPU.MaxCPUs = ec.CPU.MaxSockets * perSocket
+
+	seen := map[string]bool{}
+
+	if len(strings.TrimSpace(c.Flags)) > 0 {
+		for _, f := range strings.Split(c.Flags, ",") {
+			f = strings.TrimSpace(f)
+			m := cpuFlagRegexp.FindStringSubmatch(f)
+
+			if m == nil {
+				return fmt.Errorf("invalid cpu flag %s, use +FLAG or -FLAG", f)
+			}
+
+			if seen[m[2]] {
+				return fmt.Errorf("duplicated cpu flag %s", m[2])
+			}
+
+			seen[m[2]] = true
+			ec.CPU.Features = append(ec.CPU.Features, f)
+		}
+	}
+
+	if c.IOThreads < 0 {
+		return fmt.Errorf("cpu.iothreads must not be negative")
+	}
+
+	if err := enrichPinning(ec); err != nil {
+		return err
+	}
+
+	if c.Nested != nil {
+		flag, err := nestedFlag(ec, *c.Nested)
+
+		if err != nil {
+			return err
+		}
+
+		if seen[flag] {
+			return fmt.Errorf("cpu.nested conflicts with cpu flag %s", flag)
+		}
+
+		if *c.Nested {
+			ec.CPU.Features = append(ec.CPU.Features, "+"+flag)
+		} else {
+			ec.CPU.Features = append(ec.CPU.Features, "-"+flag)
+		}
+	}
+
+	return nil
+}
+
+func enrichPinning(ec *EnrichedConfig) error {
+	p := ec.CPU.Pinning
+
+	if len(p.VCPUs) < 1 && len(p.Emulator) < 1 && len(p.IOThreads) < 1 {
+		return nil
+	}
+
+	online, err := util.OnlineCPUs()
+
+	if err != nil {
+		return err
+	}
+
+	cpuSet := func(field, s string) ([]int, error) {
+		cpus, err := util.ParseCPUSet(s)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", field, err)
+		}
+
+		for _, c := range cpus {
+			if !containsInt(online, c) {
+				return nil, fmt.Errorf("%s: host cpu %d is not online", field, c)
+			}
+		}
+
+		return cpus, nil
+	}
+
+	ec.CPU.VCPUPins = map[int][]int{}
+
+	for vcpu, s := range p.VCPUs {
+		if vcpu < 0 || vcpu >= ec.CPU.MaxCPUs {
+			return fmt.Errorf("cpu.pinning.vcpus: vcpu %d out of range 0-%d", vcpu, ec.CPU.MaxCPUs-1)
+		}
+
+		if ec.CPU.VCPUPins[vcpu], err = cpuSet(fmt.Sprintf("cpu.pinning.vcpus.%d", vcpu), s); err != nil {
+			return err
+		}
+	}
+
+	if len(p.Emulator) > 0 {
+		if ec.CPU.EmulatorPins, err = cpuSet("cpu.pinning.emulator", p.Emulator); err != nil {
+			return err
+		}
+	}
+
+	if len(p.IOThreads) > 0 {
+		if ec.CPU.IOThreads < 1 {
+			return fmt.Errorf("cpu.pinning.iothreads requires cpu.iothreads")
+		}
+
+		if ec.CPU.IOThreadPins, err = cpuSet("cpu.pinning.iothreads", p.IOThreads); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Nested guests need the vendor's virtualization extension exposed and the
+// host KVM module loaded with nested=1.
+func nestedFlag(ec *EnrichedConfig, enable bool) (string, error) {
+	if ec.Arch != ArchX8664 {
+		return "", fmt.Errorf("cpu.nested is not supported by arch %s", ec.Arch)
+	}
+
+	for module, flag := range map[string]string{"kvm_intel": "vmx", "kvm_amd": "svm"} {
+		nested, err := ioutil.ReadFile(path.Join("/sys/module", module, "parameters", "nested"))
+
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		switch strings.TrimSpace(string(nested)) {
+		case "1", "Y":
+		default:
+			if enable {
+				return "", fmt.Errorf("cpu.nested: nested virtualization is disabled on the host, reload %s with nested=1", module)
+			}
+		}
+
+		return flag, nil
+	}
+
+	return "", fmt.Errorf("cpu.nested: kvm_intel or kvm_amd module not loaded")
+}
+
+func checkCPUModel(ec *EnrichedConfig) error {
+	if ec.CPU.Model == cpuModelHost && len(ec.CPU.Features) < 1 {
+		return nil
+	}
+
+	out, err := exec.Command(ec.Progs.Qemu.Path, "-cpu", "help").Output()
+
+	if err != nil {
+		return fmt.Errorf("%s -cpu help: %v", ec.Progs.Qemu.Path, err)
+	}
+
+	models, flags := parseCPUHelp(out)
+
+	if !contains(models, ec.CPU.Model) {
+		return fmt.Errorf("invalid cpu.model %s, see: %s -cpu help", ec.CPU.Model, ec.Progs.Qemu.Name)
+	}
+
+	// Only x86 lists the flags it recognizes
+	if len(flags) > 0 {
+		for _, f := range ec.CPU.Features {
+			if !contains(flags, f[1:]) {
+				return fmt.Errorf("invalid cpu flag %s, see: %s -cpu help", f[1:], ec.Progs.Qemu.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// The model list lines look like "x86 Skylake-Client  Intel Core..." on older
+// QEMU versions and "  Skylake-Client  Intel Core..." on newer ones.
+func parseCPUHelp(out []byte) ([]string, []string) {
+	models := []string{}
+	flags := []string{}
+	section := ""
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case strings.HasPrefix(line, "Available CPUs:"):
+			section = "models"
+			continue
+		case strings.HasPrefix(line, "Recognized CPUID flags:"):
+			section = "flags"
+			continue
+		case len(strings.TrimSpace(line)) < 1:
+			continue
+		case !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "x86 "):
+			section = ""
+			continue
+		}
+
+		fields := strings.Fields(line)
+
+		switch section {
+		case "models":
+			if fields[0] == "x86" && len(fields) > 1 {
+				fields = fields[1:]
+			}
+
+			models = append(models, fields[0])
+		case "flags":
+			flags = append(flags, fields...)
+		}
+	}
+
+	return models, flags
+}
+
+func containsInt(list []int, i int) bool {
+	for _, l := range list {
+		if l == i {
+			return true
+		}
+	}
+
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+
+	return false
+}
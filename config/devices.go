@@ -0,0 +1,99 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+func enrichDevices(ec *EnrichedConfig) error {
+	inputs := []Input{InputKeyboard, InputMouse, InputTablet, InputVirtIOKeyboard, InputVirtIOMouse, InputVirtIOTablet}
+
+	// Without a list, a display gets the tablet so the pointer follows the
+	// host one, and an empty list leaves only the machine defaults
+	if ec.Input == nil && ec.Video != VideoNone {
+		ec.Input = []Input{InputTablet}
+	}
+
+	if len(ec.Input) > 0 && ec.Video == VideoNone {
+		return fmt.Errorf("input requires video")
+	}
+
+	for i, in := range ec.Input {
+		if !containsInput(inputs, in) {
+			return fmt.Errorf("invalid input %s, choose from: %v", in, inputs)
+		}
+
+		if containsInput(ec.Input[:i], in) {
+			return fmt.Errorf("input %s listed more than once", in)
+		}
+	}
+
+	switch ec.Audio {
+	case AudioNone:
+	case AudioWAV, AudioPipeWire:
+		if !ec.Machine.PCI() {
+			return fmt.Errorf("audio is not supported by machine %s", ec.Machine.Type)
+		}
+
+		if ec.Audio == AudioWAV {
+			ec.AudioFile = path.Join(ec.State, "audio.wav")
+		}
+	default:
+		return fmt.Errorf("invalid audio %s, choose from: %v", ec.Audio, []Audio{AudioNone, AudioWAV, AudioPipeWire})
+	}
+
+	if len(ec.Config.USBStorage) > 0 && ec.Machine.Type == MachineMicroVM {
+		return fmt.Errorf("usbstorage is not supported by machine %s", ec.Machine.Type)
+	}
+
+	ec.USBStorage = nil
+
+	for i, p := range ec.Config.USBStorage {
+		d := USBDrive{ID: fmt.Sprintf("usbdisk%d", i), Drive: fmt.Sprintf("usbdrive%d", i), Path: p, Format: "raw"}
+
+		if !filepath.IsAbs(d.Path) {
+			d.Path = path.Join(ec.Home, d.Path)
+		}
+
+		if _, err := os.Stat(d.Path); err != nil {
+			return err
+		}
+
+		if strings.HasSuffix(d.Path, ".qcow2") {
+			d.Format = "qcow2"
+		}
+
+		ec.USBStorage = append(ec.USBStorage, d)
+	}
+
+	return nil
+}
+
+// USBController tells whether any device needs the USB controller, including
+// the SPICE redirection ports
+func (ec *EnrichedConfig) USBController() bool {
+	if len(ec.USB) > 0 || len(ec.USBStorage) > 0 || ec.Video == VideoQXL {
+		return true
+	}
+
+	for _, in := range ec.Input {
+		if !strings.HasPrefix(string(in), "virtio-") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsInput(list []Input, in Input) bool {
+	for _, l := range list {
+		if l == in {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,99 @@
+package config
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+const qcow2Magic = "QFI\xfb"
+
+// A plain string is still accepted as the disk path
+func (d *Disk) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw interface{}
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	if _, ok := raw.(map[interface{}]interface{}); !ok {
+		return unmarshal(&d.Path)
+	}
+
+	type plain Disk
+
+	return unmarshal((*plain)(d))
+}
+
+// Missing disks with a size are created as qcow2 images when the VM starts
+func enrichDisks(ec *EnrichedConfig) error {
+	for i, d := range ec.Config.Disks {
+		ed := EnrichedDisk{Disk: d}
+
+		if len(ed.Path) < 1 {
+			return fmt.Errorf("disks[%d].path cannot be empty", i)
+		}
+
+		if !filepath.IsAbs(ed.Path) {
+			ed.Path = path.Join(ec.Home, ed.Path)
+		}
+
+		if ed.Size < 0 {
+			return fmt.Errorf("disk %s: size must not be negative", ed.Path)
+		}
+
+		if _, err := os.Stat(ed.Path); err != nil {
+			if !os.IsNotExist(err) || ed.Size < 1 {
+				return err
+			}
+
+			if ed.Size%MiB != 0 {
+				return fmt.Errorf("disk %s: size %v must be whole MiB", ed.Path, ed.Size)
+			}
+
+			ed.Create = true
+		} else if size, err := diskSize(ed.Path); err != nil {
+			return fmt.Errorf("disk %s: %v", ed.Path, err)
+		} else {
+			// The size only applies to new disks, an existing one keeps its own
+			ed.Size = size
+		}
+
+		ec.Disks = append(ec.Disks, ed)
+	}
+
+	return nil
+}
+
+// diskSize reads the virtual size from the qcow2 header, falling back to the
+// file size for raw images.
+func diskSize(file string) (Size, error) {
+	f, err := os.Open(file)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer f.Close()
+
+	var header struct {
+		Magic   [4]byte
+		Version uint32
+		_       [16]byte
+		Size    uint64
+	}
+
+	if err := binary.Read(f, binary.BigEndian, &header); err == nil && string(header.Magic[:]) == qcow2Magic {
+		return Size(header.Size), nil
+	}
+
+	info, err := f.Stat()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return Size(info.Size()), nil
+}
@@ -0,0 +1,172 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/c1rcu17/qemuer/firmware"
+)
+
+const (
+	featureSecureBoot   = "secure-boot"
+	featureEnrolledKeys = "enrolled-keys"
+	featureRequiresSMM  = "requires-smm"
+)
+
+// Firmware for confidential computing can't boot a regular guest
+var confidentialFeatures = []string{"amd-sev", "amd-sev-es", "amd-sev-snp", "intel-tdx"}
+
+func enrichFirmware(ec *EnrichedConfig) error {
+	kind := FirmwareKind(ec.Config.Firmware)
+
+	switch kind {
+	case "":
+		switch {
+		case ec.Bios == BiosLegacy, ec.Bios == "" && ec.Machine.Type == MachineMicroVM && !ec.SecureBoot:
+			kind = FirmwareSeaBIOS
+		case ec.SecureBoot:
+			kind = FirmwareOVMFSecBoot
+		default:
+			kind = FirmwareOVMF
+		}
+	case FirmwareSeaBIOS, FirmwareOVMF, FirmwareOVMFSecBoot:
+	case FirmwareCustom:
+		return fmt.Errorf("firmware %s: set it to the path of the firmware image instead", kind)
+	default:
+		kind = FirmwareCustom
+	}
+
+	if kind == FirmwareOVMFSecBoot {
+		ec.SecureBoot = true
+	}
+
+	switch kind {
+	case FirmwareSeaBIOS, FirmwareCustom:
+		if kind == FirmwareSeaBIOS && !ec.Machine.X86() {
+			return fmt.Errorf("firmware %s is not supported by machine %s", kind, ec.Machine.Type)
+		}
+
+		if ec.Bios == BiosUEFI {
+			return fmt.Errorf("firmware %s requires bios %s", kind, BiosLegacy)
+		}
+
+		if ec.SecureBoot {
+			return fmt.Errorf("secureboot is not supported by firmware %s, choose from: %v",
+				kind, []FirmwareKind{FirmwareOVMF, FirmwareOVMFSecBoot})
+		}
+
+		ec.Bios = BiosLegacy
+	default:
+		if ec.Bios == BiosLegacy {
+			return fmt.Errorf("firmware %s requires bios %s", kind, BiosUEFI)
+		}
+
+		ec.Bios = BiosUEFI
+	}
+
+	descs, err := firmware.Load(firmware.SearchPaths()...)
+
+	if err != nil {
+		return err
+	}
+
+	switch kind {
+	case FirmwareSeaBIOS:
+		return enrichSeaBIOS(ec, descs)
+	case FirmwareCustom:
+		return enrichCustomFirmware(ec)
+	default:
+		return enrichOVMF(ec, descs)
+	}
+}
+
+func enrichSeaBIOS(ec *EnrichedConfig, descs []firmware.Descriptor) error {
+	ec.Firmware = Firmware{Kind: FirmwareSeaBIOS, Description: "QEMU default"}
+
+	if d, err := firmware.Find(descs, firmware.Query{
+		Interface: "bios",
+		Arch:      string(ec.Arch),
+		Machine:   ec.Machine.Name,
+		Device:    firmware.DeviceMemory,
+	}); err == nil {
+		ec.Firmware.Description = d.Description
+		ec.Firmware.Descriptor = d.File
+		ec.Firmware.Image = d.Mapping.Filename
+	}
+
+	return nil
+}
+
+func enrichCustomFirmware(ec *EnrichedConfig) error {
+	image := ec.Config.Firmware
+
+	if !filepath.IsAbs(image) {
+		image = path.Join(ec.Home, image)
+	}
+
+	if info, err := os.Stat(image); err != nil {
+		return err
+	} else if info.IsDir() {
+		return fmt.Errorf("firmware %s: is a directory, choose a path or one of: %v", image,
+			[]FirmwareKind{FirmwareSeaBIOS, FirmwareOVMF, FirmwareOVMFSecBoot})
+	}
+
+	ec.Firmware = Firmware{Kind: FirmwareCustom, Description: "custom image", Image: image}
+
+	return nil
+}
+
+func enrichOVMF(ec *EnrichedConfig, descs []firmware.Descriptor) error {
+	query := firmware.Query{
+		Interface: "uefi",
+		Arch:      string(ec.Arch),
+		Machine:   ec.Machine.Name,
+		Device:    firmware.DeviceFlash,
+		Exclude:   confidentialFeatures,
+	}
+
+	if ec.SecureBoot {
+		query.Require = []string{featureSecureBoot, featureEnrolledKeys}
+	} else {
+		query.Exclude = append(query.Exclude, featureEnrolledKeys)
+	}
+
+	if d, err := firmware.Find(descs, query); err == nil {
+		ec.Firmware = Firmware{
+			Description:  d.Description,
+			Descriptor:   d.File,
+			Code:         d.Mapping.Executable.Filename,
+			VarsTemplate: d.Mapping.NVRAMTemplate.Filename,
+			Vars:         path.Join(ec.State, d.Name()+"_VARS.fd"),
+			Format:       d.Mapping.NVRAMTemplate.Format,
+			SMM:          d.HasFeature(featureRequiresSMM),
+		}
+	} else if ec.SecureBoot {
+		return fmt.Errorf("secureboot: %v", err)
+	} else if ec.Arch != ArchX8664 || ec.Machine.Type == MachineMicroVM {
+		// The embedded OVMF is built for x86_64 PC machines only
+		return fmt.Errorf("firmware %s: %v", FirmwareOVMF, err)
+	} else {
+		ec.Firmware = Firmware{
+			Description:  "embedded OVMF",
+			Code:         path.Join(ec.Runtime, "OVMF_CODE.fd"),
+			VarsTemplate: path.Join(ec.Runtime, "OVMF_VARS.fd"),
+			Vars:         path.Join(ec.State, "OVMF_VARS.fd"),
+			Embedded:     true,
+		}
+	}
+
+	ec.Firmware.Kind = FirmwareOVMF
+
+	if ec.SecureBoot {
+		ec.Firmware.Kind = FirmwareOVMFSecBoot
+	}
+
+	if len(ec.Firmware.Format) < 1 {
+		ec.Firmware.Format = "raw"
+	}
+
+	return nil
+}
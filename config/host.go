@@ -0,0 +1,20 @@
+package config
+
+// CheckHost runs the pre-flight checks against the host, which only matter
+// when the VM starts: devices may be unplugged or rebound, and hugepages are
+// taken, once it is running. The sysfs root is usually /sys.
+func (ec *EnrichedConfig) CheckHost(sysfs string) error {
+	if err := checkPassthrough(ec, sysfs); err != nil {
+		return err
+	}
+
+	if err := checkHostNodes(ec, sysfs); err != nil {
+		return err
+	}
+
+	if ec.Memory.Backend == MemoryHugePages {
+		return checkHugePages(ec, sysfs)
+	}
+
+	return nil
+}
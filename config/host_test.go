@@ -0,0 +1,114 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+)
+
+// hugepages reserves free pages of the size in the global pool, or in the
+// pool of a host node unless it is empty.
+func (f *fakeSysfs) hugepages(node string, pageSize Size, free int) {
+	dir := hugePagesDir(f.root, node, pageSize)
+
+	f.mkdir(dir)
+	f.write(path.Join(dir, "free_hugepages"), fmt.Sprintf("%d\n", free))
+}
+
+func (f *fakeSysfs) nodes(online string) {
+	dir := path.Join(f.root, "devices/system/node")
+
+	f.mkdir(dir)
+	f.write(path.Join(dir, "online"), online+"\n")
+}
+
+func TestCheckHost(t *testing.T) {
+	sysfs := newFakeSysfs(t)
+	sysfs.usb("1-2.3", "046d", "c52b")
+	sysfs.pci("0000:01:00.0", "1", vfioDriver)
+	sysfs.nodes("0-1")
+	sysfs.hugepages("", 2*MiB, 1024)
+	sysfs.hugepages("node1", 2*MiB, 256)
+
+	hugepages := func(numa ...EnrichedNUMANode) EnrichedMemory {
+		m := EnrichedMemory{NUMA: numa}
+		m.Backend = MemoryHugePages
+		m.PageSize = 2 * MiB
+		m.Size = 2 * GiB
+
+		return m
+	}
+
+	node := func(memory Size, hostNodes ...int) EnrichedNUMANode {
+		n := EnrichedNUMANode{HostNodeSet: hostNodes}
+		n.Memory = memory
+
+		if len(hostNodes) > 0 {
+			n.Policy = NUMABind
+		}
+
+		return n
+	}
+
+	tests := []struct {
+		name string
+		ec   EnrichedConfig
+		err  string
+	}{
+		{"nothing to check", EnrichedConfig{}, ""},
+		{"devices", EnrichedConfig{
+			USB: []HostUSB{{ID: "hostusb0", Vendor: "046d", Product: "c52b"}},
+			PCI: []HostPCI{{ID: "hostpci0", Address: "0000:01:00.0"}},
+		}, ""},
+		{"usb unplugged", EnrichedConfig{
+			USB: []HostUSB{{ID: "hostusb0", Device: "1-4", Bus: "1", Port: "4"}},
+		}, "usb 1/4: no device plugged into bus 1 port 4"},
+		{"usb listed by id and port", EnrichedConfig{
+			USB: []HostUSB{
+				{ID: "hostusb0", Vendor: "046d", Product: "c52b"},
+				{ID: "hostusb1", Device: "1-2.3", Bus: "1", Port: "2.3"},
+			},
+		}, "device 1-2.3 is already listed by hostusb0"},
+		{"pci missing", EnrichedConfig{
+			PCI: []HostPCI{{ID: "hostpci0", Address: "0000:02:00.0"}},
+		}, "pci 0000:02:00.0: no such device"},
+		{"hugepages", EnrichedConfig{Memory: hugepages()}, ""},
+		{"hugepages unsupported", EnrichedConfig{Memory: func() EnrichedMemory {
+			m := hugepages()
+			m.PageSize = GiB
+
+			return m
+		}()}, "not supported by the host"},
+		{"hugepages per node", EnrichedConfig{Memory: hugepages(node(GiB), node(512*MiB, 1), node(512*MiB))}, ""},
+		{"hugepages add up", EnrichedConfig{Memory: hugepages(node(GiB), node(GiB))}, ""},
+		{"hugepages short", EnrichedConfig{Memory: func() EnrichedMemory {
+			m := hugepages(node(GiB+512*MiB), node(GiB+512*MiB))
+			m.Size = 3 * GiB
+
+			return m
+		}()}, "needs 1536 hugepages"},
+		{"hugepages short on node", EnrichedConfig{Memory: hugepages(node(GiB, 1), node(GiB))},
+			"needs 512 hugepages of 2 MiB but only 256 are free"},
+		{"host node offline", EnrichedConfig{Memory: hugepages(node(GiB, 2), node(GiB))},
+			"host node 2 is not online"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.ec.CheckHost(sysfs.root)
+
+			if len(tt.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
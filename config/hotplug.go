@@ -0,0 +1,123 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"gopkg.in/yaml.v2"
+)
+
+func enrichHotplug(ec *EnrichedConfig) error {
+	ec.HotplugFile = path.Join(ec.Runtime, "hotplug.yml")
+
+	if ec.Hotplug < 0 {
+		return fmt.Errorf("hotplug must not be negative")
+	}
+
+	// PCI Express buses only take hotplugged devices on root ports, while
+	// the i440fx PCI bus takes them directly
+	switch ec.Machine.Type {
+	case MachineQ35, MachineVirt:
+		for i := 0; i < ec.Hotplug; i++ {
+			ec.HotplugPorts = append(ec.HotplugPorts, fmt.Sprintf("hp%d", i))
+		}
+	case MachineMicroVM:
+		if ec.Hotplug > 0 {
+			return fmt.Errorf("hotplug is not supported by machine %s", ec.Machine.Type)
+		}
+	}
+
+	if data, err := ioutil.ReadFile(ec.HotplugFile); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+	} else if err := yaml.Unmarshal(data, &ec.Plugged); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (ec *EnrichedConfig) SaveHotplug() error {
+	data, err := yaml.Marshal(&ec.Plugged)
+
+	if err != nil {
+		return err
+	}
+
+	tmp := ec.HotplugFile + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, ec.HotplugFile)
+}
+
+// HotplugPort returns a root port without a hotplugged device, or the default
+// bus when the machine doesn't need one.
+func (ec *EnrichedConfig) HotplugPort() (string, error) {
+	if ec.Machine.Type == MachinePC {
+		return "", nil
+	}
+
+	used := map[string]bool{}
+
+	for _, d := range ec.Plugged.Disks {
+		used[d.Port] = true
+	}
+
+	for _, n := range ec.Plugged.NICs {
+		used[n.Port] = true
+	}
+
+	for _, p := range ec.HotplugPorts {
+		if !used[p] {
+			return p, nil
+		}
+	}
+
+	return "", fmt.Errorf("no free hotplug port left, raise hotplug in %s", ec.File)
+}
+
+// HotplugMAC validates the MAC address requested for a hotplugged NIC like
+// the ones in the VMFILE, or generates one when it is empty.
+func (ec *EnrichedConfig) HotplugMAC(mac string) (string, error) {
+	used, err := hostMACs()
+
+	if err != nil {
+		return "", err
+	}
+
+	nics := len(ec.Networks) + len(ec.Plugged.NICs)
+
+	for _, n := range ec.Networks {
+		used = append(used, n.MAC)
+	}
+
+	for _, n := range ec.Plugged.NICs {
+		used = append(used, n.MAC)
+	}
+
+	if len(mac) < 1 {
+		return generateMAC(ec.File, nics, used).String(), nil
+	}
+
+	return checkMAC(mac, used)
+}
+
+func (h *HotplugState) IDs() []string {
+	ids := append([]string{}, h.CPUs...)
+
+	for _, d := range h.Disks {
+		ids = append(ids, d.ID)
+	}
+
+	for _, n := range h.NICs {
+		ids = append(ids, n.ID)
+	}
+
+	return ids
+}
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+)
+
+var machineRegexp = regexp.MustCompile(`^(pc-q35|q35|pc-i440fx|i440fx|pc|microvm|virt)(?:-(\d+\.\d+))?$`)
+
+func enrichMachine(ec *EnrichedConfig) error {
+	machines := map[Arch][]MachineType{
+		ArchX8664:   {MachineQ35, MachinePC, MachineMicroVM},
+		ArchAArch64: {MachineVirt},
+	}[ec.Arch]
+
+	if len(ec.Config.Machine) < 1 {
+		ec.Machine = Machine{Type: machines[0], Name: string(machines[0])}
+		return enrichMachineDevices(ec)
+	}
+
+	m := machineRegexp.FindStringSubmatch(ec.Config.Machine)
+
+	if m == nil {
+		return fmt.Errorf("invalid machine %s, choose from: %v, optionally followed by -VERSION", ec.Config.Machine, machines)
+	}
+
+	switch m[1] {
+	case "pc-q35", "q35":
+		ec.Machine.Type = MachineQ35
+	case "pc-i440fx", "i440fx", "pc":
+		ec.Machine.Type = MachinePC
+	default:
+		ec.Machine.Type = MachineType(m[1])
+	}
+
+	ec.Machine.Version = m[2]
+
+	supported := false
+
+	for _, t := range machines {
+		if t == ec.Machine.Type {
+			supported = true
+			break
+		}
+	}
+
+	if !supported {
+		return fmt.Errorf("invalid machine %s for arch %s, choose from: %v", ec.Config.Machine, ec.Arch, machines)
+	}
+
+	switch {
+	case len(ec.Machine.Version) < 1:
+		ec.Machine.Name = string(ec.Machine.Type)
+	case ec.Machine.Type == MachineQ35:
+		ec.Machine.Name = "pc-q35-" + ec.Machine.Version
+	case ec.Machine.Type == MachinePC:
+		ec.Machine.Name = "pc-i440fx-" + ec.Machine.Version
+	case ec.Machine.Type == MachineVirt:
+		ec.Machine.Name = "virt-" + ec.Machine.Version
+	default:
+		return fmt.Errorf("invalid machine %s: %s is not versioned", ec.Config.Machine, ec.Machine.Type)
+	}
+
+	return enrichMachineDevices(ec)
+}
+
+// Not every machine can wire every device: microvm has no PCI bus and virt
+// has neither IDE nor ISA.
+func enrichMachineDevices(ec *EnrichedConfig) error {
+	switch ec.Machine.Type {
+	case MachineMicroVM:
+		if len(ec.ISO) > 0 {
+			return fmt.Errorf("iso is not supported by machine %s", ec.Machine.Type)
+		}
+
+		if ec.Video != VideoNone {
+			return fmt.Errorf("video %s is not supported by machine %s", ec.Video, ec.Machine.Type)
+		}
+
+		if ec.TPM {
+			return fmt.Errorf("tpm is not supported by machine %s", ec.Machine.Type)
+		}
+	case MachineVirt:
+		switch ec.Video {
+		case VideoNone, VideoVirtIO:
+		default:
+			return fmt.Errorf("video %s is not supported by machine %s, choose from: %v",
+				ec.Video, ec.Machine.Type, []Video{VideoNone, VideoVirtIO})
+		}
+	}
+
+	return nil
+}
+
+func (m Machine) PCI() bool {
+	return m.Type != MachineMicroVM
+}
+
+func (m Machine) X86() bool {
+	return m.Type == MachineQ35 || m.Type == MachinePC || m.Type == MachineMicroVM
+}
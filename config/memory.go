@@ -0,0 +1,346 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/c1rcu17/qemuer/util"
+)
+
+const minMemory = 64 * MiB
+
+// A plain size is still accepted as the memory size
+func (m *Memory) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw interface{}
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	fields, ok := raw.(map[interface{}]interface{})
+
+	if !ok {
+		return unmarshal(&m.Size)
+	}
+
+	// A page size must carry a unit, like 2M or 1G
+	if pageSize, exists := fields["pagesize"]; exists {
+		if _, err := strconv.ParseFloat(strings.TrimSpace(fmt.Sprint(pageSize)), 64); err == nil {
+			return fmt.Errorf("memory.pagesize %v: needs a unit, like 2M or 1G", pageSize)
+		}
+	}
+
+	type plain Memory
+
+	return unmarshal((*plain)(m))
+}
+
+func enrichMemory(ec *EnrichedConfig) error {
+	m := ec.Config.Memory
+	ec.Memory = EnrichedMemory{Memory: m}
+
+	if m.Size < minMemory {
+		hint := ""
+
+		if m.Size > 0 && m.Size%MiB == 0 {
+			hint = fmt.Sprintf(", plain numbers are MiB, did you mean %dG?", m.Size/MiB)
+		}
+
+		return fmt.Errorf("memory %v is too small, must be at least %v%s", m.Size, minMemory, hint)
+	}
+
+	if m.Size%MiB != 0 || m.MaxMem%MiB != 0 {
+		return fmt.Errorf("memory sizes must be whole MiB")
+	}
+
+	virtiofs := false
+
+	for _, s := range ec.Shares {
+		if s.Driver == ShareVirtioFS {
+			virtiofs = true
+			break
+		}
+	}
+
+	// vhost-user devices need the guest memory to be shared with the daemon
+	if virtiofs {
+		if m.Backend == MemoryRAM {
+			return fmt.Errorf("memory.backend %s cannot be shared with virtiofsd, choose from: %v",
+				m.Backend, []MemoryBackend{MemoryMemFD, MemoryHugePages})
+		}
+
+		ec.Memory.Shared = true
+	}
+
+	switch m.Backend {
+	case "":
+		switch {
+		case ec.Memory.Shared:
+			ec.Memory.Backend = MemoryMemFD
+		case m.Prealloc, len(m.NUMA) > 0:
+			ec.Memory.Backend = MemoryRAM
+		}
+	case MemoryRAM, MemoryMemFD:
+	case MemoryHugePages:
+		if err := enrichHugePages(ec); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid memory.backend %s, choose from: %v", m.Backend,
+			[]MemoryBackend{MemoryRAM, MemoryMemFD, MemoryHugePages})
+	}
+
+	if ec.Memory.Backend == MemoryRAM && ec.Memory.Shared {
+		return fmt.Errorf("memory.shared requires memory.backend: %v", []MemoryBackend{MemoryMemFD, MemoryHugePages})
+	}
+
+	if m.PageSize > 0 && ec.Memory.Backend != MemoryHugePages {
+		return fmt.Errorf("memory.pagesize requires memory.backend: %s", MemoryHugePages)
+	}
+
+	switch {
+	case m.Slots < 0:
+		return fmt.Errorf("memory.slots must not be negative")
+	case m.Slots > 0 && m.MaxMem <= m.Size:
+		return fmt.Errorf("memory.slots requires memory.maxmem greater than memory.size")
+	case m.MaxMem > 0 && m.Slots < 1:
+		return fmt.Errorf("memory.maxmem requires memory.slots")
+	case m.Slots > 0 && ec.Machine.Type == MachineMicroVM:
+		return fmt.Errorf("memory hotplug is not supported by machine %s", ec.Machine.Type)
+	}
+
+	if len(m.NUMA) > 0 {
+		if err := enrichNUMA(ec); err != nil {
+			return err
+		}
+	}
+
+	if ec.Memory.Backend == MemoryHugePages {
+		sizes := []Size{ec.Memory.Size}
+
+		for _, n := range ec.Memory.NUMA {
+			sizes = append(sizes, n.Memory)
+		}
+
+		for _, size := range sizes {
+			if size%ec.Memory.PageSize != 0 {
+				return fmt.Errorf("memory size %v is not a multiple of the %v hugepage size", size, ec.Memory.PageSize)
+			}
+		}
+	}
+
+	return nil
+}
+
+func enrichNUMA(ec *EnrichedConfig) error {
+	if ec.Machine.Type == MachineMicroVM {
+		return fmt.Errorf("memory.numa is not supported by machine %s", ec.Machine.Type)
+	}
+
+	var err error
+
+	assigned := map[int]int{}
+	total := Size(0)
+
+	for i, n := range ec.Config.Memory.NUMA {
+		en := EnrichedNUMANode{NUMANode: n}
+
+		if en.Memory < MiB || en.Memory%MiB != 0 {
+			return fmt.Errorf("memory.numa[%d].memory must be whole MiB greater than 0", i)
+		}
+
+		total += en.Memory
+
+		if len(en.CPUs) < 1 {
+			return fmt.Errorf("memory.numa[%d].cpus cannot be empty", i)
+		}
+
+		if en.CPUSet, err = util.ParseCPUSet(en.CPUs); err != nil {
+			return fmt.Errorf("memory.numa[%d].cpus: %v", i, err)
+		}
+
+		for _, c := range en.CPUSet {
+			if c >= ec.CPU.MaxCPUs {
+				return fmt.Errorf("memory.numa[%d].cpus: vcpu %d out of range 0-%d", i, c, ec.CPU.MaxCPUs-1)
+			}
+
+			if o, ok := assigned[c]; ok {
+				return fmt.Errorf("memory.numa[%d].cpus: vcpu %d already in node %d", i, c, o)
+			}
+
+			assigned[c] = i
+		}
+
+		if len(en.HostNodes) > 0 {
+			// Node lists share the cpu list syntax
+			if en.HostNodeSet, err = util.ParseCPUSet(en.HostNodes); err != nil {
+				return fmt.Errorf("memory.numa[%d].hostnodes: %v", i, err)
+			}
+		}
+
+		switch en.Policy {
+		case "":
+			if len(en.HostNodeSet) > 0 {
+				en.Policy = NUMABind
+			}
+		case NUMAPreferred, NUMABind, NUMAInterleave:
+			if len(en.HostNodeSet) < 1 {
+				return fmt.Errorf("memory.numa[%d].policy requires hostnodes", i)
+			}
+		default:
+			return fmt.Errorf("invalid memory.numa[%d].policy %s, choose from: %v", i, en.Policy,
+				[]NUMAPolicy{NUMAPreferred, NUMABind, NUMAInterleave})
+		}
+
+		ec.Memory.NUMA = append(ec.Memory.NUMA, en)
+	}
+
+	if total != ec.Memory.Size {
+		return fmt.Errorf("memory.numa: nodes add up to %v, expected memory.size %v", total, ec.Memory.Size)
+	}
+
+	if len(assigned) != ec.CPU.MaxCPUs {
+		return fmt.Errorf("memory.numa: every vcpu from 0 to %d must be assigned to a node", ec.CPU.MaxCPUs-1)
+	}
+
+	return nil
+}
+
+func enrichHugePages(ec *EnrichedConfig) error {
+	if ec.Memory.PageSize < 1 {
+		size, err := defaultHugePageSize()
+
+		if err != nil {
+			return err
+		}
+
+		ec.Memory.PageSize = size
+	}
+
+	ec.Memory.Backend = MemoryHugePages
+
+	return nil
+}
+
+// checkHugePages makes sure the host has enough free hugepages for the guest,
+// on the bound host node when a guest node has a single one. Nodes drawing
+// from the same pool add up, and the pages are only free until the VM starts.
+func checkHugePages(ec *EnrichedConfig, sysfs string) error {
+	pageSize := ec.Memory.PageSize
+
+	if _, err := os.Stat(hugePagesDir(sysfs, "", pageSize)); err != nil {
+		return fmt.Errorf("memory.pagesize %v is not supported by the host", pageSize)
+	}
+
+	pools := map[string]Size{}
+	var order []string
+
+	demand := func(dir string, size Size) {
+		if _, ok := pools[dir]; !ok {
+			order = append(order, dir)
+		}
+
+		pools[dir] += size
+	}
+
+	if len(ec.Memory.NUMA) < 1 {
+		demand(hugePagesDir(sysfs, "", pageSize), ec.Memory.Size)
+	}
+
+	for _, n := range ec.Memory.NUMA {
+		dir := hugePagesDir(sysfs, "", pageSize)
+
+		if n.Policy == NUMABind && len(n.HostNodeSet) == 1 {
+			dir = hugePagesDir(sysfs, fmt.Sprintf("node%d", n.HostNodeSet[0]), pageSize)
+		}
+
+		demand(dir, n.Memory)
+	}
+
+	for _, dir := range order {
+		data, err := ioutil.ReadFile(path.Join(dir, "free_hugepages"))
+
+		if err != nil {
+			return err
+		}
+
+		free, err := strconv.Atoi(strings.TrimSpace(string(data)))
+
+		if err != nil {
+			return err
+		}
+
+		if need := int(pools[dir] / pageSize); need > free {
+			return fmt.Errorf("memory needs %d hugepages of %v but only %d are free in %s", need, pageSize, free, dir)
+		}
+	}
+
+	return nil
+}
+
+// checkHostNodes makes sure the host nodes the guest nodes are bound to are
+// online.
+func checkHostNodes(ec *EnrichedConfig, sysfs string) error {
+	if len(ec.Memory.NUMA) < 1 {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(path.Join(sysfs, "devices/system/node/online"))
+
+	if err != nil {
+		return err
+	}
+
+	online, err := util.ParseCPUSet(strings.TrimSpace(string(data)))
+
+	if err != nil {
+		return err
+	}
+
+	for i, n := range ec.Memory.NUMA {
+		for _, h := range n.HostNodeSet {
+			if !containsInt(online, h) {
+				return fmt.Errorf("memory.numa[%d].hostnodes: host node %d is not online", i, h)
+			}
+		}
+	}
+
+	return nil
+}
+
+func hugePagesDir(sysfs, node string, pageSize Size) string {
+	dir := fmt.Sprintf("hugepages-%dkB", pageSize/KiB)
+
+	if len(node) > 0 {
+		return path.Join(sysfs, "devices/system/node", node, "hugepages", dir)
+	}
+
+	return path.Join(sysfs, "kernel/mm/hugepages", dir)
+}
+
+func defaultHugePageSize() (Size, error) {
+	f, err := os.Open("/proc/meminfo")
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 1 && fields[0] == "Hugepagesize:" {
+			kb, err := strconv.Atoi(fields[1])
+
+			return Size(kb) * KiB, err
+		}
+	}
+
+	return 0, fmt.Errorf("hugepages are not supported by the host")
+}
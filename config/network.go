@@ -0,0 +1,528 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/c1rcu17/qemuer/util"
+)
+
+const subnetPrefix = 24
+
+var subnetPools = []string{"192.168.0.0/16", "172.16.0.0/12", "10.0.0.0/8"}
+
+var forwardRegexp = regexp.MustCompile(`^host:(\d+)\s*->\s*guest:(\d+)(?:/(tcp|udp))?$`)
+
+var hostnameRegexp = regexp.MustCompile(`^(?i)[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?(\.[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?)*$`)
+
+func enrichNetworks(ec *EnrichedConfig) error {
+	var interfaces []string
+	var macs []string
+
+	routes, err := util.Routes()
+
+	if err != nil {
+		return err
+	}
+
+	subnets, err := loadSubnets()
+
+	if err != nil {
+		return err
+	}
+
+	if ifaces, err := net.Interfaces(); err != nil {
+		return err
+	} else {
+		for _, i := range ifaces {
+			interfaces = append(interfaces, i.Name)
+		}
+	}
+
+	if macs, err = hostMACs(); err != nil {
+		return err
+	}
+
+	for i, n := range ec.Config.Networks {
+		en := EnrichedNetwork{Network: n}
+
+		if len(en.Network.Name) < 1 {
+			en.Network.Name = fmt.Sprintf("net%d", i)
+		}
+
+		for _, o := range ec.Networks {
+			if o.Network.Name == en.Network.Name {
+				return fmt.Errorf("network %s: listed more than once", en.Network.Name)
+			}
+		}
+
+		if len(en.MAC) < 1 || en.MAC == MACAuto {
+			en.MAC = generateMAC(ec.File, i, macs).String()
+		}
+
+		if en.MAC, err = checkMAC(en.MAC, macs); err != nil {
+			return err
+		}
+
+		macs = append(macs, en.MAC)
+
+		switch en.Mode {
+		case "":
+			en.Mode = NetworkNAT
+			fallthrough
+		case NetworkNAT:
+			if err := enrichNATNetwork(ec, &en, interfaces, routes, subnets); err != nil {
+				return err
+			}
+		case NetworkIsolated:
+			if err := enrichIsolatedNetwork(&en); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("invalid mode %s, choose from: %v", en.Mode, []NetworkMode{NetworkNAT, NetworkIsolated})
+		}
+
+		for _, o := range ec.Networks {
+			for _, f := range en.PortForwards {
+				for _, of := range o.PortForwards {
+					if f.Proto == of.Proto && f.HostPort == of.HostPort {
+						return fmt.Errorf("forward host:%d/%s: already in use", f.HostPort, f.Proto)
+					}
+				}
+			}
+
+			if o.Name != en.Name {
+				continue
+			}
+
+			if len(en.IP) > 0 && en.IP == o.IP {
+				return fmt.Errorf("address %s: reserved more than once in network %s", en.IP, en.CIDR)
+			}
+
+			if len(en.Hostname) > 0 && en.Hostname == o.Hostname {
+				return fmt.Errorf("hostname %s: reserved more than once in network %s", en.Hostname, en.CIDR)
+			}
+		}
+
+		ec.Networks = append(ec.Networks, en)
+	}
+
+	return nil
+}
+
+func enrichNATNetwork(ec *EnrichedConfig, en *EnrichedNetwork, interfaces []string,
+	routes []util.Route, subnets subnets) error {
+	if len(en.Segment) > 0 {
+		return fmt.Errorf("segment %s: not supported by %s networks", en.Segment, NetworkNAT)
+	}
+
+	if len(en.NatDev) > 0 {
+		for j, iface := range interfaces {
+			if en.NatDev == iface {
+				break
+			}
+			if j == len(interfaces)-1 {
+				return fmt.Errorf("invalid natdev %s, choose from: %v", en.NatDev, interfaces)
+			}
+		}
+	}
+
+	key := fmt.Sprintf("%s/%s", ec.Name, en.Network.Name)
+
+	// Automatic subnets are only persisted by run, see SaveSubnets
+	if en.CIDR == CIDRAuto {
+		en.SubnetKey = key
+
+		if cidr, err := subnets.lookup(ec, key); err != nil {
+			return err
+		} else if len(cidr) > 0 {
+			en.CIDR = cidr
+		} else if cidr, err := allocateSubnet(ec, routes, subnets); err != nil {
+			return err
+		} else {
+			en.CIDR = cidr
+		}
+
+		subnets[key] = subnet{CIDR: en.CIDR, File: ec.File}
+	}
+
+	if addr, subnet, err := net.ParseCIDR(en.CIDR); err != nil {
+		return err
+	} else {
+		en.Subnet = subnet.IP.String()
+		en.Netmask = net.IP(subnet.Mask).String()
+
+		if !addr.Equal(subnet.IP) {
+			return fmt.Errorf("invalid subnet address %s: it should be %s", addr, en.Subnet)
+		}
+
+		if gw, bc, start, end, err := util.AddressRange(subnet); err != nil {
+			return err
+		} else {
+			en.Gateway = gw.String()
+			en.Broadcast = bc.String()
+			en.IPStart = start.String()
+			en.IPEnd = end.String()
+		}
+
+		if len(en.IP) > 0 {
+			if err := enrichReservation(en, subnet); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(en.Hostname) > 0 && !hostnameRegexp.MatchString(en.Hostname) {
+		return fmt.Errorf("invalid hostname %s: must be a valid DNS name", en.Hostname)
+	}
+
+	if len(en.CIDR6) > 0 {
+		if err := enrichNetwork6(en); err != nil {
+			return err
+		}
+	} else if len(en.IPv6) > 0 {
+		return fmt.Errorf("ipv6 %s: requires cidr6", en.IPv6)
+	}
+
+	seed := en.Subnet + en.Netmask
+
+	if len(en.Subnet6) > 0 {
+		seed += fmt.Sprintf("%s/%d", en.Subnet6, en.Prefix6)
+	}
+
+	id := fmt.Sprintf("%x", sha256.Sum256([]byte(seed)))[:8]
+	en.Name = fmt.Sprintf("net-%s", id)
+	en.BridgeDev = fmt.Sprintf("br-%s", id)
+
+	if err := checkOverlaps(en, key, routes, subnets); err != nil {
+		return err
+	}
+
+	for _, f := range en.Forwards {
+		if pf, err := parseForward(f); err != nil {
+			return err
+		} else {
+			for _, o := range en.PortForwards {
+				if o.Proto == pf.Proto && o.HostPort == pf.HostPort {
+					return fmt.Errorf("forward host:%d/%s: already in use", pf.HostPort, pf.Proto)
+				}
+			}
+
+			en.PortForwards = append(en.PortForwards, pf)
+		}
+	}
+
+	if len(en.TFTP) > 0 {
+		if !filepath.IsAbs(en.TFTP) {
+			en.TFTP = filepath.Join(ec.Home, en.TFTP)
+		}
+
+		if info, err := os.Stat(en.TFTP); err != nil {
+			return err
+		} else if !info.IsDir() {
+			return fmt.Errorf("tftp %s: not a directory", en.TFTP)
+		}
+
+		if len(en.BootFile) < 1 {
+			return fmt.Errorf("tftp %s: requires a bootfile", en.TFTP)
+		}
+	}
+
+	if len(en.BootServer) > 0 {
+		if ip := net.ParseIP(en.BootServer); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid bootserver %s: not an IPv4 address", en.BootServer)
+		} else {
+			en.BootServer = ip.String()
+		}
+
+		if len(en.BootFile) < 1 {
+			return fmt.Errorf("bootserver %s: requires a bootfile", en.BootServer)
+		}
+	}
+
+	return nil
+}
+
+func parseForward(f string) (PortForward, error) {
+	pf := PortForward{Proto: "tcp"}
+	m := forwardRegexp.FindStringSubmatch(strings.TrimSpace(f))
+
+	if m == nil {
+		return pf, fmt.Errorf("invalid forward %s: expected host:PORT -> guest:PORT[/tcp|udp]", f)
+	}
+
+	for i, port := range []*int{&pf.HostPort, &pf.GuestPort} {
+		if n, err := strconv.Atoi(m[i+1]); err != nil || n < 1 || n > 65535 {
+			return pf, fmt.Errorf("invalid forward %s: port %s out of range", f, m[i+1])
+		} else {
+			*port = n
+		}
+	}
+
+	if len(m[3]) > 0 {
+		pf.Proto = m[3]
+	}
+
+	return pf, nil
+}
+
+func enrichIsolatedNetwork(en *EnrichedNetwork) error {
+	if len(en.Forwards) > 0 {
+		return fmt.Errorf("forwards: not supported by %s networks", NetworkIsolated)
+	}
+
+	fields := []string{"natdev", "cidr", "cidr6", "ip", "hostname", "ipv6", "tftp", "bootfile", "bootserver"}
+
+	for i, value := range []string{en.NatDev, en.CIDR, en.CIDR6, en.IP, en.Hostname, string(en.IPv6),
+		en.TFTP, en.BootFile, en.BootServer} {
+		if len(value) > 0 {
+			return fmt.Errorf("%s %s: not supported by %s networks", fields[i], value, NetworkIsolated)
+		}
+	}
+
+	if len(en.Segment) < 1 {
+		en.Segment = "default"
+	}
+
+	// Every VM joining the same segment meets on the same multicast group,
+	// bound to the loopback so frames never leave the host
+	sum := sha256.Sum256([]byte(en.Segment))
+	port := 1024 + int(binary.BigEndian.Uint16(sum[2:4]))%(65536-1024)
+	en.MCast = fmt.Sprintf("239.192.%d.%d:%d", sum[0], sum[1], port)
+	en.Name = fmt.Sprintf("seg-%x", sum[:4])
+
+	return nil
+}
+
+func enrichNetwork6(en *EnrichedNetwork) error {
+	addr, subnet, err := net.ParseCIDR(en.CIDR6)
+
+	if err != nil {
+		return err
+	}
+
+	if addr.To4() != nil {
+		return fmt.Errorf("invalid cidr6 %s: not an IPv6 subnet", en.CIDR6)
+	}
+
+	en.Subnet6 = subnet.IP.String()
+	en.Prefix6, _ = subnet.Mask.Size()
+
+	if !addr.Equal(subnet.IP) {
+		return fmt.Errorf("invalid subnet address %s: it should be %s", addr, en.Subnet6)
+	}
+
+	switch en.IPv6 {
+	case "":
+		en.IPv6 = IPv6DHCP
+	case IPv6DHCP:
+	case IPv6SLAAC:
+		if en.Prefix6 != 64 {
+			return fmt.Errorf("invalid cidr6 %s: slaac requires a /64 prefix", en.CIDR6)
+		}
+	default:
+		return fmt.Errorf("invalid ipv6 %s, choose from: %v", en.IPv6, []IPv6Mode{IPv6DHCP, IPv6SLAAC})
+	}
+
+	if gw, start, end, err := util.AddressRange6(subnet); err != nil {
+		return err
+	} else {
+		en.Gateway6 = gw.String()
+
+		if en.IPv6 == IPv6DHCP {
+			en.IPStart6 = start.String()
+			en.IPEnd6 = end.String()
+		}
+	}
+
+	return nil
+}
+
+func checkOverlaps(en *EnrichedNetwork, key string, routes []util.Route, subnets subnets) error {
+	_, subnet, err := net.ParseCIDR(en.CIDR)
+
+	if err != nil {
+		return err
+	}
+
+	for _, r := range routes {
+		if ones, _ := r.Dest.Mask.Size(); ones == 0 || r.Iface == en.BridgeDev {
+			continue
+		}
+
+		if util.Overlaps(subnet, r.Dest) {
+			return fmt.Errorf("invalid cidr %s: overlaps %s on %s", en.CIDR, r.Dest, r.Iface)
+		}
+	}
+
+	for k, s := range subnets {
+		if k == key {
+			continue
+		}
+
+		if _, other, err := net.ParseCIDR(s.CIDR); err == nil && util.Overlaps(subnet, other) {
+			return fmt.Errorf("invalid cidr %s: overlaps %s allocated to %s", en.CIDR, s.CIDR, k)
+		}
+	}
+
+	return nil
+}
+
+func allocateSubnet(ec *EnrichedConfig, routes []util.Route, subnets subnets) (string, error) {
+	var used []*net.IPNet
+
+	for _, r := range routes {
+		if ones, _ := r.Dest.Mask.Size(); ones > 0 {
+			used = append(used, r.Dest)
+		}
+	}
+
+	for _, s := range subnets {
+		if _, n, err := net.ParseCIDR(s.CIDR); err == nil {
+			used = append(used, n)
+		}
+	}
+
+	for _, n := range ec.Config.Networks {
+		if _, n, err := net.ParseCIDR(n.CIDR); err == nil {
+			used = append(used, n)
+		}
+	}
+
+	for _, pool := range subnetPools {
+		_, p, err := net.ParseCIDR(pool)
+
+		if err != nil {
+			return "", err
+		}
+
+		ones, _ := p.Mask.Size()
+		base := binary.BigEndian.Uint32(p.IP.To4())
+
+		for i := uint32(0); i < 1<<(subnetPrefix-ones); i++ {
+			ip := make(net.IP, net.IPv4len)
+			binary.BigEndian.PutUint32(ip, base+i<<(32-subnetPrefix))
+			candidate := &net.IPNet{IP: ip, Mask: net.CIDRMask(subnetPrefix, 32)}
+			free := true
+
+			for _, u := range used {
+				if util.Overlaps(candidate, u) {
+					free = false
+					break
+				}
+			}
+
+			if free {
+				return candidate.String(), nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("cannot allocate a free subnet from %v", subnetPools)
+}
+
+// checkMAC normalizes a guest MAC address, which must be a unique, unicast
+// and locally administered one.
+func checkMAC(addr string, used []string) (string, error) {
+	mac, err := net.ParseMAC(addr)
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(mac) != 6 {
+		return "", fmt.Errorf("address %s: is not a 48-bit MAC address", addr)
+	}
+
+	addr = mac.String()
+
+	for _, m := range used {
+		if addr == m {
+			return "", fmt.Errorf("address %s: already in use", addr)
+		}
+	}
+
+	first_byte := mac[0]
+
+	if first_byte&0b01 != 0 {
+		return "", fmt.Errorf("address %s: is a multicast MAC address. see: "+
+			"https://en.wikipedia.org/wiki/MAC_address#Unicast_vs._multicast", addr)
+	}
+
+	if first_byte&0b10 == 0 {
+		return "", fmt.Errorf("address %s: is a universally administered MAC address (UAA). see: "+
+			"https://en.wikipedia.org/wiki/MAC_address#Universal_vs._local", addr)
+	}
+
+	return addr, nil
+}
+
+func hostMACs() ([]string, error) {
+	var macs []string
+
+	ifaces, err := net.Interfaces()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, i := range ifaces {
+		if i.HardwareAddr != nil {
+			macs = append(macs, i.HardwareAddr.String())
+		}
+	}
+
+	return macs, nil
+}
+
+func generateMAC(file string, index int, used []string) net.HardwareAddr {
+	for salt := 0; ; salt++ {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%s#%d#%d", file, index, salt)))
+		mac := net.HardwareAddr(sum[:6])
+
+		// Force a locally administered unicast address
+		mac[0] = mac[0]&^0b01 | 0b10
+
+		taken := false
+
+		for _, m := range used {
+			if mac.String() == m {
+				taken = true
+				break
+			}
+		}
+
+		if !taken {
+			return mac
+		}
+	}
+}
+
+func enrichReservation(en *EnrichedNetwork, subnet *net.IPNet) error {
+	ip := net.ParseIP(en.IP)
+
+	if ip == nil || ip.To4() == nil {
+		return fmt.Errorf("invalid ip %s: not an IPv4 address", en.IP)
+	}
+
+	if !subnet.Contains(ip) {
+		return fmt.Errorf("invalid ip %s: not inside %s", en.IP, en.CIDR)
+	}
+
+	en.IP = ip.String()
+
+	for _, reserved := range []string{en.Subnet, en.Gateway, en.Broadcast} {
+		if en.IP == reserved {
+			return fmt.Errorf("invalid ip %s: reserved by network %s", en.IP, en.CIDR)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,237 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const vfioDriver = "vfio-pci"
+
+var (
+	usbIDRegexp   = regexp.MustCompile(`^([0-9a-fA-F]{4}):([0-9a-fA-F]{4})$`)
+	usbPortRegexp = regexp.MustCompile(`^(\d+)/(\d+(?:\.\d+)*)$`)
+	pciAddrRegexp = regexp.MustCompile(`^(?:([0-9a-fA-F]{4}):)?([0-9a-fA-F]{2}:[0-1][0-9a-fA-F]\.[0-7])$`)
+)
+
+// The devices are only looked up on the host when the VM starts, see
+// checkPassthrough
+func enrichPassthrough(ec *EnrichedConfig) error {
+	if len(ec.Config.USB) > 0 && ec.Machine.Type == MachineMicroVM {
+		return fmt.Errorf("usb is not supported by machine %s", ec.Machine.Type)
+	}
+
+	if len(ec.Config.PCI) > 0 && !ec.Machine.PCI() {
+		return fmt.Errorf("pci is not supported by machine %s", ec.Machine.Type)
+	}
+
+	ec.USB = nil
+
+	for i, u := range ec.Config.USB {
+		dev, err := parseUSB(u)
+
+		if err != nil {
+			return fmt.Errorf("usb %s: %v", u, err)
+		}
+
+		dev.ID = fmt.Sprintf("hostusb%d", i)
+
+		for _, d := range ec.USB {
+			if d.Vendor == dev.Vendor && d.Product == dev.Product && d.Bus == dev.Bus && d.Port == dev.Port {
+				return fmt.Errorf("usb %s: listed more than once", u)
+			}
+		}
+
+		ec.USB = append(ec.USB, dev)
+	}
+
+	ec.PCI = nil
+
+	for i, p := range ec.Config.PCI {
+		dev, err := parsePCI(p)
+
+		if err != nil {
+			return fmt.Errorf("pci %s: %v", p, err)
+		}
+
+		dev.ID = fmt.Sprintf("hostpci%d", i)
+
+		for _, d := range ec.PCI {
+			if d.Address == dev.Address {
+				return fmt.Errorf("pci %s: listed more than once", p)
+			}
+		}
+
+		ec.PCI = append(ec.PCI, dev)
+	}
+
+	return nil
+}
+
+// checkPassthrough makes sure the devices are plugged in and free to be
+// passed through. A device listed both by vendor:product and bus/port is only
+// found to be the same here.
+func checkPassthrough(ec *EnrichedConfig, sysfs string) error {
+	for i := range ec.USB {
+		dev := &ec.USB[i]
+
+		if err := findUSB(sysfs, dev); err != nil {
+			if len(dev.Port) > 0 {
+				return fmt.Errorf("usb %s/%s: %v", dev.Bus, dev.Port, err)
+			}
+
+			return fmt.Errorf("usb %s:%s: %v", dev.Vendor, dev.Product, err)
+		}
+
+		for _, d := range ec.USB[:i] {
+			if d.Device == dev.Device {
+				return fmt.Errorf("usb %s: device %s is already listed by %s", dev.ID, dev.Device, d.ID)
+			}
+		}
+	}
+
+	for i := range ec.PCI {
+		if err := findPCI(sysfs, &ec.PCI[i]); err != nil {
+			return fmt.Errorf("pci %s: %v", ec.PCI[i].Address, err)
+		}
+	}
+
+	return nil
+}
+
+// USB devices are either selected by vendor:product, or by the physical
+// bus/port they are plugged into.
+func parseUSB(spec string) (HostUSB, error) {
+	if m := usbPortRegexp.FindStringSubmatch(spec); m != nil {
+		return HostUSB{Device: m[1] + "-" + m[2], Bus: m[1], Port: m[2]}, nil
+	}
+
+	if m := usbIDRegexp.FindStringSubmatch(spec); m != nil {
+		return HostUSB{Vendor: strings.ToLower(m[1]), Product: strings.ToLower(m[2])}, nil
+	}
+
+	return HostUSB{}, fmt.Errorf("invalid device, use vendor:product like 046d:c52b or bus/port like 1/2.3")
+}
+
+// findUSB looks the device up in sysfs, which must hold a single match for a
+// vendor:product.
+func findUSB(sysfs string, dev *HostUSB) error {
+	devices := path.Join(sysfs, "bus/usb/devices")
+
+	if len(dev.Port) > 0 {
+		if _, err := os.Stat(path.Join(devices, dev.Device)); err != nil {
+			return fmt.Errorf("no device plugged into bus %s port %s", dev.Bus, dev.Port)
+		}
+
+		dev.Vendor = readSysfs(path.Join(devices, dev.Device, "idVendor"))
+		dev.Product = readSysfs(path.Join(devices, dev.Device, "idProduct"))
+
+		return nil
+	}
+
+	matches, err := filepath.Glob(path.Join(devices, "*", "idVendor"))
+
+	if err != nil {
+		return err
+	}
+
+	var found []string
+
+	for _, f := range matches {
+		dir := filepath.Dir(f)
+
+		if readSysfs(f) == dev.Vendor && readSysfs(path.Join(dir, "idProduct")) == dev.Product {
+			found = append(found, filepath.Base(dir))
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return fmt.Errorf("no such device")
+	case 1:
+		dev.Device = found[0]
+		return nil
+	default:
+		return fmt.Errorf("matches %d devices, use bus/port instead", len(found))
+	}
+}
+
+func parsePCI(spec string) (HostPCI, error) {
+	m := pciAddrRegexp.FindStringSubmatch(spec)
+
+	if m == nil {
+		return HostPCI{}, fmt.Errorf("invalid address, use one like 0000:01:00.0")
+	}
+
+	domain := m[1]
+
+	if len(domain) < 1 {
+		domain = "0000"
+	}
+
+	return HostPCI{Address: strings.ToLower(domain + ":" + m[2])}, nil
+}
+
+// Every device in the IOMMU group of the passed through device must be
+// released by the host drivers.
+func findPCI(sysfs string, dev *HostPCI) error {
+	dir := path.Join(sysfs, "bus/pci/devices", dev.Address)
+
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("no such device")
+	}
+
+	if group, err := os.Readlink(path.Join(dir, "iommu_group")); err != nil {
+		return fmt.Errorf("no IOMMU group, enable the IOMMU in the firmware and the kernel command line")
+	} else {
+		dev.IOMMUGroup = filepath.Base(group)
+	}
+
+	if driver := pciDriver(sysfs, dev.Address); driver != vfioDriver {
+		return fmt.Errorf("bound to driver %s, bind it to %s", orNone(driver), vfioDriver)
+	}
+
+	members, err := ioutil.ReadDir(path.Join(sysfs, "kernel/iommu_groups", dev.IOMMUGroup, "devices"))
+
+	if err != nil {
+		return err
+	}
+
+	for _, member := range members {
+		// Bridges stay with the host
+		switch driver := pciDriver(sysfs, member.Name()); driver {
+		case "", vfioDriver, "pcieport":
+		default:
+			return fmt.Errorf("IOMMU group %s: device %s is bound to driver %s, bind it to %s",
+				dev.IOMMUGroup, member.Name(), driver, vfioDriver)
+		}
+	}
+
+	return nil
+}
+
+func pciDriver(sysfs, address string) string {
+	if driver, err := os.Readlink(path.Join(sysfs, "bus/pci/devices", address, "driver")); err == nil {
+		return filepath.Base(driver)
+	}
+
+	return ""
+}
+
+func readSysfs(file string) string {
+	data, _ := ioutil.ReadFile(file)
+
+	return strings.TrimSpace(string(data))
+}
+
+func orNone(s string) string {
+	if len(s) < 1 {
+		return "none"
+	}
+
+	return s
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// fakeSysfs builds the parts of sysfs read by the passthrough checks
+type fakeSysfs struct {
+	t    *testing.T
+	root string
+}
+
+func newFakeSysfs(t *testing.T) *fakeSysfs {
+	return &fakeSysfs{t: t, root: t.TempDir()}
+}
+
+func (f *fakeSysfs) usb(device, vendor, product string) {
+	dir := path.Join(f.root, "bus/usb/devices", device)
+
+	f.mkdir(dir)
+	f.write(path.Join(dir, "idVendor"), vendor+"\n")
+	f.write(path.Join(dir, "idProduct"), product+"\n")
+}
+
+// pci adds a device to an IOMMU group, or without one when group is empty,
+// bound to driver unless it is empty.
+func (f *fakeSysfs) pci(address, group, driver string) {
+	dir := path.Join(f.root, "bus/pci/devices", address)
+
+	f.mkdir(dir)
+
+	if len(group) > 0 {
+		groupDir := path.Join(f.root, "kernel/iommu_groups", group, "devices")
+
+		f.mkdir(groupDir)
+		f.symlink(path.Join("../../../../kernel/iommu_groups", group), path.Join(dir, "iommu_group"))
+		f.symlink(path.Join("../../../../bus/pci/devices", address), path.Join(groupDir, address))
+	}
+
+	if len(driver) > 0 {
+		f.mkdir(path.Join(f.root, "bus/pci/drivers", driver))
+		f.symlink(path.Join("../../../../bus/pci/drivers", driver), path.Join(dir, "driver"))
+	}
+}
+
+func (f *fakeSysfs) mkdir(dir string) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+func (f *fakeSysfs) write(file, data string) {
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+func (f *fakeSysfs) symlink(target, link string) {
+	if err := os.Symlink(target, link); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+func TestFindUSB(t *testing.T) {
+	sysfs := newFakeSysfs(t)
+	sysfs.usb("1-2.3", "046d", "c52b")
+	sysfs.usb("2-1", "1d6b", "0002")
+	sysfs.usb("3-1", "1d6b", "0002")
+
+	tests := []struct {
+		name, spec string
+		want       HostUSB
+		err        string
+	}{
+		{"bus/port", "1/2.3", HostUSB{Device: "1-2.3", Bus: "1", Port: "2.3", Vendor: "046d", Product: "c52b"}, ""},
+		{"bus/port unplugged", "1/4", HostUSB{}, "no device plugged into bus 1 port 4"},
+		{"vendor:product single", "046D:C52B", HostUSB{Device: "1-2.3", Vendor: "046d", Product: "c52b"}, ""},
+		{"vendor:product none", "1234:5678", HostUSB{}, "no such device"},
+		{"vendor:product many", "1d6b:0002", HostUSB{}, "matches 2 devices"},
+		{"invalid", "logitech", HostUSB{}, "invalid device"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dev, err := parseUSB(tt.spec)
+
+			if err == nil {
+				err = findUSB(sysfs.root, &dev)
+			}
+
+			if len(tt.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if dev != tt.want {
+				t.Errorf("got %+v, want %+v", dev, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindPCI(t *testing.T) {
+	sysfs := newFakeSysfs(t)
+	sysfs.pci("0000:01:00.0", "1", vfioDriver)
+	sysfs.pci("0000:01:00.1", "1", vfioDriver)
+	sysfs.pci("0000:00:01.0", "1", "pcieport")
+	sysfs.pci("0000:02:00.0", "", vfioDriver)
+	sysfs.pci("0000:03:00.0", "3", "nvme")
+	sysfs.pci("0000:04:00.0", "4", vfioDriver)
+	sysfs.pci("0000:04:00.1", "4", "snd_hda_intel")
+	sysfs.pci("0000:05:00.0", "5", "")
+
+	tests := []struct {
+		name, spec string
+		want       HostPCI
+		err        string
+	}{
+		{"group with a bridge", "01:00.0", HostPCI{Address: "0000:01:00.0", IOMMUGroup: "1"}, ""},
+		{"domain", "0000:01:00.1", HostPCI{Address: "0000:01:00.1", IOMMUGroup: "1"}, ""},
+		{"missing", "0000:09:00.0", HostPCI{}, "no such device"},
+		{"no iommu group", "0000:02:00.0", HostPCI{}, "no IOMMU group"},
+		{"bound to another driver", "0000:03:00.0", HostPCI{}, "bound to driver nvme"},
+		{"not bound", "0000:05:00.0", HostPCI{}, "bound to driver none"},
+		{"group member bound", "0000:04:00.0", HostPCI{}, "device 0000:04:00.1 is bound to driver snd_hda_intel"},
+		{"bridge itself", "0000:00:01.0", HostPCI{}, "bound to driver pcieport"},
+		{"invalid", "1:2:3", HostPCI{}, "invalid address"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dev, err := parsePCI(tt.spec)
+
+			if err == nil {
+				err = findPCI(sysfs.root, &dev)
+			}
+
+			if len(tt.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if dev != tt.want {
+				t.Errorf("got %+v, want %+v", dev, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+)
+
+const maxShareTag = 36
+
+func enrichShares(ec *EnrichedConfig) error {
+	ec.Progs.Virtiofsd.Name = "virtiofsd"
+	lookupErr := ec.Progs.Virtiofsd.Which()
+
+	if lookupErr == nil && len(ec.Config.Shares) > 0 {
+		lookupErr = checkVirtiofsd(ec.Progs.Virtiofsd.Path)
+	}
+
+	for i, s := range ec.Config.Shares {
+		es := EnrichedShare{Share: s}
+
+		if len(es.Path) < 1 {
+			return fmt.Errorf("shares[%d].path cannot be empty", i)
+		}
+
+		if !filepath.IsAbs(es.Path) {
+			es.Path = path.Join(ec.Home, es.Path)
+		}
+
+		if info, err := os.Stat(es.Path); err != nil {
+			return err
+		} else if !info.IsDir() {
+			return fmt.Errorf("share %s: not a directory", es.Path)
+		}
+
+		if len(es.Tag) < 1 {
+			es.Tag = filepath.Base(es.Path)
+		}
+
+		if len(es.Tag) > maxShareTag {
+			return fmt.Errorf("share tag %s: longer than %d characters", es.Tag, maxShareTag)
+		}
+
+		for _, o := range ec.Shares {
+			if es.Tag == o.Tag {
+				return fmt.Errorf("share tag %s: already in use", es.Tag)
+			}
+		}
+
+		switch es.Driver {
+		case "":
+			if lookupErr == nil {
+				es.Driver = ShareVirtioFS
+			} else {
+				es.Driver = Share9P
+			}
+		case ShareVirtioFS:
+			if lookupErr != nil {
+				return fmt.Errorf("share %s: %v", es.Tag, lookupErr)
+			}
+		case Share9P:
+		default:
+			return fmt.Errorf("invalid share driver %s, choose from: %v", es.Driver, []ShareDriver{ShareVirtioFS, Share9P})
+		}
+
+		if es.Driver == ShareVirtioFS {
+			es.Socket = path.Join(ec.Runtime, fmt.Sprintf("virtiofsd-%d.sock", i))
+			es.PIDFile = path.Join(ec.Runtime, fmt.Sprintf("virtiofsd-%d.pid", i))
+		}
+
+		ec.Shares = append(ec.Shares, es)
+	}
+
+	return nil
+}
+
+// The C virtiofsd shipped by older QEMU releases, which can be found next to
+// QEMU's other helpers, takes its options with -o. Only the Rust one accepts
+// the flags virtiofsd is started with.
+func checkVirtiofsd(file string) error {
+	out, _ := exec.Command(file, "--help").CombinedOutput()
+
+	if !bytes.Contains(out, []byte("--shared-dir")) {
+		return fmt.Errorf("%s is the legacy C virtiofsd, install the Rust one", file)
+	}
+
+	return nil
+}
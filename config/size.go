@@ -0,0 +1,89 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type Size int64
+
+const (
+	Byte Size = 1
+	KiB       = 1024 * Byte
+	MiB       = 1024 * KiB
+	GiB       = 1024 * MiB
+	TiB       = 1024 * GiB
+)
+
+var (
+	sizeRegexp = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([kKmMgGtT]?)(i?[bB])?$`)
+	sizeUnits  = map[string]Size{"": MiB, "k": KiB, "m": MiB, "g": GiB, "t": TiB}
+)
+
+// ParseSize reads sizes like 2G, 512MiB or 1.5GB, all units being binary.
+// A plain number is in MiB, to stay compatible with older VMFILEs.
+func ParseSize(s string) (Size, error) {
+	m := sizeRegexp.FindStringSubmatch(strings.TrimSpace(s))
+
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q, use a number followed by K, M, G or T (plain numbers are MiB)", s)
+	}
+
+	unit := sizeUnits[strings.ToLower(m[2])]
+
+	if len(m[2]) < 1 && len(m[3]) > 0 {
+		unit = Byte
+	}
+
+	value, err := strconv.ParseFloat(m[1], 64)
+
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %v", s, err)
+	}
+
+	size := Size(value * float64(unit))
+
+	if float64(size) != value*float64(unit) {
+		return 0, fmt.Errorf("invalid size %q: not a whole number of bytes", s)
+	}
+
+	return size, nil
+}
+
+func (s *Size) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw string
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	size, err := ParseSize(raw)
+
+	if err != nil {
+		return err
+	}
+
+	*s = size
+
+	return nil
+}
+
+func (s Size) MiB() int {
+	return int(s / MiB)
+}
+
+// String picks the largest unit that keeps the size whole, like 1536 MiB
+func (s Size) String() string {
+	for _, u := range []struct {
+		size Size
+		name string
+	}{{TiB, "TiB"}, {GiB, "GiB"}, {MiB, "MiB"}, {KiB, "KiB"}} {
+		if s >= u.size && s%u.size == 0 {
+			return fmt.Sprintf("%d %s", s/u.size, u.name)
+		}
+	}
+
+	return fmt.Sprintf("%d B", int64(s))
+}
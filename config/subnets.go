@@ -0,0 +1,158 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"gopkg.in/yaml.v2"
+)
+
+const subnetsFile = "/var/lib/qemuer/subnets.yml"
+
+type (
+	// Subnets maps the VM and network names to their automatic subnet,
+	// along with the VMFILE that owns it.
+	subnets map[string]subnet
+
+	subnet struct {
+		CIDR string
+		File string
+	}
+)
+
+// The lock held by run while it allocates and saves subnets
+var subnetsLock *os.File
+
+// LockSubnets serializes automatic subnet allocation between VMs. It must
+// be taken before the config is enriched, so the allocation it computes is
+// still free when SaveSubnets persists it.
+func LockSubnets() (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(subnetsFile), 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(subnetsFile, os.O_RDWR|os.O_CREATE, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	subnetsLock = f
+
+	return func() {
+		subnetsLock = nil
+		f.Close()
+	}, nil
+}
+
+// SaveSubnets persists the automatic subnets of the VM, and drops the ones
+// of networks and VMFILEs that are gone.
+func (ec *EnrichedConfig) SaveSubnets() error {
+	if subnetsLock == nil {
+		return fmt.Errorf("subnets are not locked")
+	}
+
+	s, err := loadSubnets()
+
+	if err != nil {
+		return err
+	}
+
+	keys := map[string]bool{}
+
+	for _, n := range ec.Networks {
+		if len(n.SubnetKey) > 0 {
+			keys[n.SubnetKey] = true
+			s[n.SubnetKey] = subnet{CIDR: n.CIDR, File: ec.File}
+		}
+	}
+
+	for k, e := range s {
+		if e.File == ec.File && !keys[k] {
+			delete(s, k)
+		} else if _, err := os.Stat(e.File); os.IsNotExist(err) {
+			delete(s, k)
+		}
+	}
+
+	data, err := yaml.Marshal(s)
+
+	if err != nil {
+		return err
+	}
+
+	if err := subnetsLock.Truncate(0); err != nil {
+		return err
+	}
+
+	if _, err := subnetsLock.WriteAt(data, 0); err != nil {
+		return err
+	}
+
+	return subnetsLock.Sync()
+}
+
+// Readers share the lock, as the file is rewritten in place
+func loadSubnets() (subnets, error) {
+	f := subnetsLock
+
+	if f == nil {
+		var err error
+
+		if f, err = os.Open(subnetsFile); err != nil {
+			if os.IsNotExist(err) {
+				return subnets{}, nil
+			}
+
+			return nil, err
+		}
+
+		defer f.Close()
+
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(f)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s := subnets{}
+
+	if err := yaml.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// lookup finds the subnet of a network, adopting the entry of a moved VMFILE.
+func (s subnets) lookup(ec *EnrichedConfig, key string) (string, error) {
+	if e, exists := s[key]; exists {
+		if e.File != ec.File {
+			if _, err := os.Stat(e.File); err == nil {
+				return "", fmt.Errorf("network %s: subnet %s is allocated to %s, rename the VM or the network", key, e.CIDR, e.File)
+			}
+		}
+
+		return e.CIDR, nil
+	}
+
+	return "", nil
+}
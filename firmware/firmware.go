@@ -0,0 +1,209 @@
+package firmware
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type (
+	Descriptor struct {
+		Description    string   `json:"description"`
+		InterfaceTypes []string `json:"interface-types"`
+		Mapping        Mapping  `json:"mapping"`
+		Targets        []Target `json:"targets"`
+		Features       []string `json:"features"`
+		File           string   `json:"-"`
+	}
+
+	Mapping struct {
+		Device        string `json:"device"`
+		Mode          string `json:"mode"`
+		Executable    *File  `json:"executable"`
+		NVRAMTemplate *File  `json:"nvram-template"`
+		Filename      string `json:"filename"`
+	}
+
+	File struct {
+		Filename string `json:"filename"`
+		Format   string `json:"format"`
+	}
+
+	Target struct {
+		Architecture string   `json:"architecture"`
+		Machines     []string `json:"machines"`
+	}
+
+	Query struct {
+		Interface, Arch, Machine string
+		Device                   string
+		Require, Exclude         []string
+	}
+)
+
+const (
+	DeviceFlash  = "flash"
+	DeviceMemory = "memory"
+	ModeSplit    = "split"
+)
+
+// SearchPaths lists the descriptor directories from the lowest to the
+// highest priority, as defined by the QEMU firmware interoperability spec.
+func SearchPaths() []string {
+	dirs := []string{"/usr/share/qemu/firmware", "/etc/qemu/firmware"}
+
+	if config := os.Getenv("XDG_CONFIG_HOME"); len(config) > 0 {
+		dirs = append(dirs, path.Join(config, "qemu/firmware"))
+	} else if home := os.Getenv("HOME"); len(home) > 0 {
+		dirs = append(dirs, path.Join(home, ".config/qemu/firmware"))
+	}
+
+	return dirs
+}
+
+func Load(dirs ...string) ([]Descriptor, error) {
+	files := make(map[string]string)
+
+	for _, dir := range dirs {
+		matches, err := filepath.Glob(path.Join(dir, "*.json"))
+
+		if err != nil {
+			return nil, err
+		}
+
+		// A file in a higher priority directory replaces the ones with the
+		// same name, and an empty one hides them altogether
+		for _, m := range matches {
+			files[filepath.Base(m)] = m
+		}
+	}
+
+	names := make([]string, 0, len(files))
+
+	for name := range files {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var descs []Descriptor
+
+	for _, name := range names {
+		data, err := ioutil.ReadFile(files[name])
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(data) < 1 {
+			continue
+		}
+
+		d := Descriptor{File: files[name]}
+
+		if err := json.Unmarshal(data, &d); err != nil {
+			return nil, fmt.Errorf("firmware descriptor %s: %v", files[name], err)
+		}
+
+		descs = append(descs, d)
+	}
+
+	return descs, nil
+}
+
+func Find(descs []Descriptor, q Query) (*Descriptor, error) {
+	for i := range descs {
+		if descs[i].Matches(q) {
+			return &descs[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("no %s firmware found for %s/%s with features %v", q.Interface, q.Arch, q.Machine, q.Require)
+}
+
+func (d *Descriptor) Matches(q Query) bool {
+	if !contains(d.InterfaceTypes, q.Interface) {
+		return false
+	}
+
+	if len(q.Device) > 0 && d.Mapping.Device != q.Device {
+		return false
+	}
+
+	if d.Mapping.Device == DeviceFlash {
+		if len(d.Mapping.Mode) > 0 && d.Mapping.Mode != ModeSplit {
+			return false
+		}
+
+		if d.Mapping.Executable == nil || d.Mapping.NVRAMTemplate == nil {
+			return false
+		}
+	}
+
+	for _, f := range q.Require {
+		if !contains(d.Features, f) {
+			return false
+		}
+	}
+
+	for _, f := range q.Exclude {
+		if contains(d.Features, f) {
+			return false
+		}
+	}
+
+	for _, t := range d.Targets {
+		if t.Architecture != q.Arch {
+			continue
+		}
+
+		for _, m := range t.Machines {
+			if matchMachine(m, q.Machine) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (d *Descriptor) HasFeature(feature string) bool {
+	return contains(d.Features, feature)
+}
+
+func (d *Descriptor) Name() string {
+	return strings.TrimSuffix(filepath.Base(d.File), ".json")
+}
+
+// Descriptors list versioned machine types, like pc-q35-*, while the VMFILE
+// may use an alias that always resolves to the latest version.
+func matchMachine(pattern, machine string) bool {
+	if ok, _ := path.Match(pattern, machine); ok {
+		return true
+	}
+
+	for alias, prefix := range map[string]string{"q35": "pc-q35-", "pc": "pc-i440fx-", "virt": "virt-"} {
+		if machine == alias {
+			if ok, _ := path.Match(pattern, prefix+"latest"); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+
+	return false
+}
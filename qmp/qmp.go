@@ -0,0 +1,104 @@
+package qmp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+type (
+	Monitor struct {
+		conn net.Conn
+		dec  *json.Decoder
+		enc  *json.Encoder
+	}
+
+	Error struct {
+		Class string `json:"class"`
+		Desc  string `json:"desc"`
+	}
+
+	command struct {
+		Execute   string      `json:"execute"`
+		Arguments interface{} `json:"arguments,omitempty"`
+	}
+
+	response struct {
+		Return json.RawMessage `json:"return"`
+		Error  *Error          `json:"error"`
+		Event  string          `json:"event"`
+		QMP    interface{}     `json:"QMP"`
+	}
+)
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Class, e.Desc)
+}
+
+// Dial connects to a QMP socket and leaves the capabilities negotiation mode
+// so commands can be executed right away.
+func Dial(socket string, timeout time.Duration) (*Monitor, error) {
+	conn, err := net.DialTimeout("unix", socket, timeout)
+
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Monitor{conn: conn, dec: json.NewDecoder(conn), enc: json.NewEncoder(conn)}
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	var greeting response
+
+	if err := m.dec.Decode(&greeting); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("qmp greeting: %v", err)
+	} else if greeting.QMP == nil {
+		conn.Close()
+		return nil, fmt.Errorf("qmp greeting: unexpected message")
+	}
+
+	if err := m.Execute("qmp_capabilities", nil, nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return m, conn.SetDeadline(time.Time{})
+}
+
+// Execute runs a command and decodes its return value into result, which may
+// be nil. Asynchronous events received meanwhile are discarded.
+func (m *Monitor) Execute(cmd string, args interface{}, result interface{}) error {
+	if err := m.enc.Encode(command{Execute: cmd, Arguments: args}); err != nil {
+		return err
+	}
+
+	for {
+		var r response
+
+		if err := m.dec.Decode(&r); err != nil {
+			return fmt.Errorf("%s: %v", cmd, err)
+		}
+
+		switch {
+		case len(r.Event) > 0:
+			continue
+		case r.Error != nil:
+			return fmt.Errorf("%s: %w", cmd, r.Error)
+		case result != nil && r.Return != nil:
+			if err := json.Unmarshal(r.Return, result); err != nil {
+				return fmt.Errorf("%s: %v", cmd, err)
+			}
+		}
+
+		return nil
+	}
+}
+
+func (m *Monitor) Close() error {
+	return m.conn.Close()
+}
@@ -1,27 +1,117 @@
-//go:generate go run gen/gen.go
-
 package static
 
 import (
-	"bytes"
 	"compress/gzip"
-	"encoding/base64"
+	"embed"
 	"fmt"
 	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+type (
+	Resource struct {
+		Name, Version, Hash string
+	}
+
+	resourceReader struct {
+		*gzip.Reader
+		file fs.File
+	}
 )
 
+const (
+	resourcesDir = "resources"
+	versionsFile = "versions.txt"
+	hashesFile   = "sha256sums.txt"
+	resourceExt  = ".gz"
+)
+
+//go:embed resources versions.txt sha256sums.txt
+var files embed.FS
+
+func Resources() ([]Resource, error) {
+	entries, err := fs.ReadDir(files, resourcesDir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]Resource, 0, len(entries))
+
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), resourceExt) {
+			continue
+		}
+
+		if r, err := LookupResource("/" + strings.TrimSuffix(e.Name(), resourceExt)); err != nil {
+			return nil, err
+		} else {
+			list = append(list, r)
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list, nil
+}
+
+func LookupResource(name string) (Resource, error) {
+	r := Resource{Name: name}
+
+	if version, err := lookupField(versionsFile, name, 0, 1); err != nil {
+		return r, err
+	} else {
+		r.Version = version
+	}
+
+	// The hashes are written by make, in the format of sha256sum
+	if hash, err := lookupField(hashesFile, name, 1, 0); err != nil {
+		return r, err
+	} else {
+		r.Hash = hash
+	}
+
+	return r, nil
+}
+
 func OpenResource(name string) (io.ReadCloser, error) {
-	if b64, exists := resources[name]; !exists {
+	if f, err := files.Open(path.Join(resourcesDir, name+resourceExt)); err != nil {
 		return nil, fmt.Errorf("resource not found %s", name)
 	} else {
-		if compressed, err := base64.StdEncoding.DecodeString(b64); err != nil {
+		if reader, err := gzip.NewReader(f); err != nil {
+			f.Close()
 			return nil, err
 		} else {
-			if reader, err := gzip.NewReader(bytes.NewReader(compressed)); err != nil {
-				return nil, err
-			} else {
-				return reader, nil
-			}
+			return &resourceReader{Reader: reader, file: f}, nil
+		}
+	}
+}
+
+func (r *resourceReader) Close() error {
+	err := r.Reader.Close()
+
+	if ferr := r.file.Close(); err == nil {
+		err = ferr
+	}
+
+	return err
+}
+
+func lookupField(file, name string, key, value int) (string, error) {
+	data, err := files.ReadFile(file)
+
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[key] == name {
+			return fields[value], nil
 		}
 	}
+
+	return "", fmt.Errorf("resource %s: missing from %s", name, file)
 }
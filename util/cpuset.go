@@ -0,0 +1,99 @@
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// ParseCPUSet parses a kernel style cpu list like "0-3,8,10-11".
+func ParseCPUSet(s string) ([]int, error) {
+	seen := map[int]bool{}
+	cpus := []int{}
+
+	for _, r := range strings.Split(strings.TrimSpace(s), ",") {
+		bounds := strings.SplitN(strings.TrimSpace(r), "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("invalid cpu set %s", s)
+		}
+
+		last := first
+
+		if len(bounds) > 1 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first {
+				return nil, fmt.Errorf("invalid cpu set %s", s)
+			}
+		}
+
+		for c := first; c <= last; c++ {
+			if !seen[c] {
+				seen[c] = true
+				cpus = append(cpus, c)
+			}
+		}
+	}
+
+	sort.Ints(cpus)
+
+	return cpus, nil
+}
+
+func OnlineCPUs() ([]int, error) {
+	data, err := ioutil.ReadFile("/sys/devices/system/cpu/online")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseCPUSet(string(data))
+}
+
+func SetAffinity(tid int, cpus []int) error {
+	mask := make([]uint64, 1)
+
+	for _, c := range cpus {
+		for c/64 >= len(mask) {
+			mask = append(mask, 0)
+		}
+
+		mask[c/64] |= 1 << uint(c%64)
+	}
+
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, uintptr(tid),
+		uintptr(len(mask)*8), uintptr(unsafe.Pointer(&mask[0])))
+
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// FormatCPUSet returns the ranges of a sorted cpu list, like ["0-3", "8"].
+func FormatCPUSet(cpus []int) []string {
+	ranges := []string{}
+
+	for i := 0; i < len(cpus); {
+		j := i
+
+		for j+1 < len(cpus) && cpus[j+1] == cpus[j]+1 {
+			j++
+		}
+
+		if i == j {
+			ranges = append(ranges, strconv.Itoa(cpus[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", cpus[i], cpus[j]))
+		}
+
+		i = j + 1
+	}
+
+	return ranges
+}
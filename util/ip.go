@@ -6,11 +6,19 @@ import (
 	"net"
 )
 
+const maxRange6 = 0xffff
+
 func AddressRange(subnet *net.IPNet) (gw net.IP, bc net.IP, start net.IP, end net.IP, err error) {
 	prefixLen, bits := subnet.Mask.Size()
+
+	if bits != 8*net.IPv4len || subnet.IP.To4() == nil {
+		err = fmt.Errorf("invalid subnet %s: not an IPv4 subnet", subnet)
+		return
+	}
+
 	hostLen := uint(bits) - uint(prefixLen)
 
-	subnetInt := (&big.Int{}).SetBytes([]byte(subnet.IP))
+	subnetInt := (&big.Int{}).SetBytes([]byte(subnet.IP.To4()))
 
 	gwInt := (&big.Int{}).Set(subnetInt)
 	gwInt.Add(gwInt, big.NewInt(1))
@@ -39,6 +47,50 @@ func AddressRange(subnet *net.IPNet) (gw net.IP, bc net.IP, start net.IP, end ne
 	return
 }
 
+// AddressRange6 has no broadcast address to skip, but the DHCPv6 range is
+// capped to the last 16 bits of the subnet since libvirt refuses wider ones.
+func AddressRange6(subnet *net.IPNet) (gw net.IP, start net.IP, end net.IP, err error) {
+	prefixLen, bits := subnet.Mask.Size()
+
+	if bits != 8*net.IPv6len || subnet.IP.To4() != nil {
+		err = fmt.Errorf("invalid subnet %s: not an IPv6 subnet", subnet)
+		return
+	}
+
+	hostLen := uint(bits) - uint(prefixLen)
+
+	subnetInt := (&big.Int{}).SetBytes([]byte(subnet.IP.To16()))
+
+	gwInt := (&big.Int{}).Set(subnetInt)
+	gwInt.Add(gwInt, big.NewInt(1))
+
+	lastInt := big.NewInt(1)
+	lastInt.Lsh(lastInt, hostLen)
+	lastInt.Sub(lastInt, big.NewInt(1))
+	lastInt.Or(lastInt, subnetInt)
+
+	startInt := (&big.Int{}).Set(gwInt)
+	startInt.Add(startInt, big.NewInt(1))
+
+	endInt := (&big.Int{}).Set(subnetInt)
+	endInt.Add(endInt, big.NewInt(maxRange6))
+
+	if endInt.Cmp(lastInt) > 0 {
+		endInt.Set(lastInt)
+	}
+
+	if startInt.Cmp(endInt) > 0 {
+		err = fmt.Errorf("invalid prefix /%d: too narrow", prefixLen)
+		return
+	}
+
+	gw = intToIP(gwInt, bits)
+	start = intToIP(startInt, bits)
+	end = intToIP(endInt, bits)
+
+	return
+}
+
 func intToIP(ipInt *big.Int, bits int) net.IP {
 	ipBytes := ipInt.Bytes()
 	ret := make([]byte, bits/8)
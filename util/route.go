@@ -0,0 +1,100 @@
+package util
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+type Route struct {
+	Iface string
+	Dest  *net.IPNet
+}
+
+// Routes lists the IPv4 subnets reachable from the host, both from the
+// routing table and from the addresses assigned to its interfaces.
+func Routes() ([]Route, error) {
+	var routes []Route
+
+	if ifaces, err := net.Interfaces(); err != nil {
+		return nil, err
+	} else {
+		for _, i := range ifaces {
+			if addrs, err := i.Addrs(); err != nil {
+				return nil, err
+			} else {
+				for _, a := range addrs {
+					if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil {
+						routes = append(routes, Route{Iface: i.Name, Dest: &net.IPNet{
+							IP:   n.IP.To4().Mask(n.Mask),
+							Mask: n.Mask,
+						}})
+					}
+				}
+			}
+		}
+	}
+
+	f, err := os.Open("/proc/net/route")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	// Skip the header
+	scanner.Scan()
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		if len(fields) < 8 {
+			continue
+		}
+
+		dest, err := parseHexIP(fields[1])
+
+		if err != nil {
+			return nil, err
+		}
+
+		mask, err := parseHexIP(fields[7])
+
+		if err != nil {
+			return nil, err
+		}
+
+		routes = append(routes, Route{Iface: fields[0], Dest: &net.IPNet{IP: dest, Mask: net.IPMask(mask)}})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return routes, nil
+}
+
+func Overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+func parseHexIP(s string) (net.IP, error) {
+	b, err := hex.DecodeString(s)
+
+	if err != nil || len(b) != net.IPv4len {
+		return nil, fmt.Errorf("invalid route address %s", s)
+	}
+
+	// The kernel prints addresses in host byte order
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(b))
+
+	return ip, nil
+}